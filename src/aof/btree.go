@@ -0,0 +1,274 @@
+package aof
+
+import "sort"
+
+// btreeDegree is the minimum degree of a B-tree: its nodes but the root hold
+// from btreeDegree-1 to 2*btreeDegree-1 items
+const btreeDegree = 16
+
+type btreeItem struct {
+	key string
+	v   StoreValue
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode // nil for a leaf
+}
+
+// BTreeStore is an in-memory store that iterates its keys in order
+type BTreeStore struct {
+	root *btreeNode
+	size int
+}
+
+func NewBTreeStore() *BTreeStore {
+	return &BTreeStore{}
+}
+
+// Len returns the number of keys of the store
+func (s *BTreeStore) Len() int {
+	return s.size
+}
+
+// find returns the index of the first item whose key is not less than key
+func (n *btreeNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].key >= key })
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+func (s *BTreeStore) Get(key string) (StoreValue, bool, error) {
+	for n := s.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].v, true, nil
+		} else if n.children == nil {
+			break
+		}
+		n = n.children[i]
+	}
+	return StoreValue{}, false, nil
+}
+
+func (s *BTreeStore) Put(key string, v StoreValue) error {
+	for n := s.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			n.items[i].v = v
+			return nil
+		} else if n.children == nil {
+			break
+		}
+		n = n.children[i]
+	}
+
+	s.size++
+	if s.root == nil {
+		s.root = &btreeNode{items: []btreeItem{{key, v}}}
+		return nil
+	}
+	if len(s.root.items) == 2*btreeDegree-1 {
+		s.root = &btreeNode{children: []*btreeNode{s.root}}
+		s.root.split(0)
+	}
+	s.root.insert(btreeItem{key, v})
+	return nil
+}
+
+// split moves the upper half of a full child to a new child after it
+func (n *btreeNode) split(i int) {
+	child := n.children[i]
+	mid := btreeDegree - 1
+	item := child.items[mid]
+
+	right := &btreeNode{items: append([]btreeItem{}, child.items[mid+1:]...)}
+	if child.children != nil {
+		right.children = append([]*btreeNode{}, child.children[mid+1:]...)
+		for j := mid + 1; j < len(child.children); j++ {
+			child.children[j] = nil
+		}
+		child.children = child.children[:mid+1]
+	}
+	for j := mid; j < len(child.items); j++ {
+		child.items[j] = btreeItem{}
+	}
+	child.items = child.items[:mid]
+
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = item
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+// insert adds a new item under a node that is not full
+func (n *btreeNode) insert(item btreeItem) {
+	i, _ := n.find(item.key)
+	if n.children == nil {
+		n.items = append(n.items, btreeItem{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = item
+		return
+	}
+
+	if len(n.children[i].items) == 2*btreeDegree-1 {
+		n.split(i)
+		if item.key > n.items[i].key {
+			i++
+		}
+	}
+	n.children[i].insert(item)
+}
+
+func (s *BTreeStore) Delete(key string) error {
+	if s.root == nil {
+		return nil
+	}
+	if s.root.remove(key) {
+		s.size--
+	}
+	if len(s.root.items) == 0 {
+		if s.root.children == nil {
+			s.root = nil
+		} else {
+			s.root = s.root.children[0]
+		}
+	}
+	return nil
+}
+
+// remove deletes key under a node that holds at least btreeDegree items, or
+// under the root, and tells whether it was there
+func (n *btreeNode) remove(key string) bool {
+	i, found := n.find(key)
+	if n.children == nil {
+		if found {
+			n.removeItem(i)
+		}
+		return found
+	}
+
+	if found {
+		left, right := n.children[i], n.children[i+1]
+		switch {
+		case len(left.items) >= btreeDegree:
+			pred := left.max()
+			n.items[i] = pred
+			return left.remove(pred.key)
+		case len(right.items) >= btreeDegree:
+			succ := right.min()
+			n.items[i] = succ
+			return right.remove(succ.key)
+		}
+		n.merge(i)
+		return n.children[i].remove(key)
+	}
+
+	// the child the key is under gets an item more before the descent
+	if len(n.children[i].items) == btreeDegree-1 {
+		switch {
+		case i > 0 && len(n.children[i-1].items) >= btreeDegree:
+			n.rotateRight(i - 1)
+		case i < len(n.children)-1 && len(n.children[i+1].items) >= btreeDegree:
+			n.rotateLeft(i)
+		case i < len(n.children)-1:
+			n.merge(i)
+		default:
+			n.merge(i - 1)
+			i--
+		}
+	}
+	return n.children[i].remove(key)
+}
+
+func (n *btreeNode) removeItem(i int) {
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = btreeItem{}
+	n.items = n.items[:len(n.items)-1]
+}
+
+func (n *btreeNode) removeChild(i int) {
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+func (n *btreeNode) min() btreeItem {
+	for n.children != nil {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for n.children != nil {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+// merge joins the children around item i and the item into one child
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.removeItem(i)
+	n.removeChild(i + 1)
+}
+
+// rotateRight moves item i down to the right child and the last item of the left child up
+func (n *btreeNode) rotateRight(i int) {
+	left, right := n.children[i], n.children[i+1]
+	right.items = append(right.items, btreeItem{})
+	copy(right.items[1:], right.items)
+	right.items[0] = n.items[i]
+	n.items[i] = left.items[len(left.items)-1]
+	left.removeItem(len(left.items) - 1)
+
+	if left.children != nil {
+		right.children = append(right.children, nil)
+		copy(right.children[1:], right.children)
+		right.children[0] = left.children[len(left.children)-1]
+		left.removeChild(len(left.children) - 1)
+	}
+}
+
+// rotateLeft moves item i down to the left child and the first item of the right child up
+func (n *btreeNode) rotateLeft(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	n.items[i] = right.items[0]
+	right.removeItem(0)
+
+	if right.children != nil {
+		left.children = append(left.children, right.children[0])
+		right.removeChild(0)
+	}
+}
+
+// Iterate passes the keys to fn in order
+func (s *BTreeStore) Iterate(fn func(key string, v StoreValue) error) error {
+	if s.root == nil {
+		return nil
+	}
+	return s.root.iterate(fn)
+}
+
+func (n *btreeNode) iterate(fn func(key string, v StoreValue) error) error {
+	for i, item := range n.items {
+		if n.children != nil {
+			if err := n.children[i].iterate(fn); err != nil {
+				return err
+			}
+		}
+		if err := fn(item.key, item.v); err != nil {
+			return err
+		}
+	}
+	if n.children != nil {
+		return n.children[len(n.children)-1].iterate(fn)
+	}
+	return nil
+}
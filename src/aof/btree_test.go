@@ -0,0 +1,91 @@
+package aof
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkBTree verifies the sizes of the nodes, the order of the keys and that all the leaves are at the same depth
+func checkBTree(t *testing.T, n *btreeNode, root bool, lo, hi string, depth int, leafDepth *int) {
+	if !root {
+		assert.True(t, len(n.items) >= btreeDegree-1, "node of %d items", len(n.items))
+	}
+	assert.True(t, len(n.items) <= 2*btreeDegree-1, "node of %d items", len(n.items))
+	for i, item := range n.items {
+		assert.True(t, (lo == "" || item.key > lo) && (hi == "" || item.key < hi))
+		if i > 0 {
+			assert.True(t, n.items[i-1].key < item.key)
+		}
+	}
+
+	if n.children == nil {
+		if *leafDepth < 0 {
+			*leafDepth = depth
+		}
+		assert.Equal(t, *leafDepth, depth)
+		return
+	}
+	assert.Equal(t, len(n.items)+1, len(n.children))
+	for i, child := range n.children {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = n.items[i-1].key
+		}
+		if i < len(n.items) {
+			chi = n.items[i].key
+		}
+		checkBTree(t, child, false, clo, chi, depth+1, leafDepth)
+	}
+}
+
+func TestBTreeStore(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	s := NewBTreeStore()
+	expected := make(map[string]StoreValue)
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%04d", rnd.Intn(3000))
+		if i > 15000 || rnd.Intn(3) == 0 {
+			assert.Nil(t, s.Delete(key))
+			delete(expected, key)
+		} else {
+			v := StoreValue{Value: i, Deleted: rnd.Intn(5) == 0}
+			assert.Nil(t, s.Put(key, v))
+			expected[key] = v
+		}
+
+		if i%1000 == 0 && s.root != nil {
+			leafDepth := -1
+			checkBTree(t, s.root, true, "", "", 0, &leafDepth)
+		}
+	}
+	assert.Equal(t, len(expected), s.Len())
+
+	keys := []string{}
+	assert.Nil(t, s.Iterate(func(key string, v StoreValue) error {
+		keys = append(keys, key)
+		assert.Equal(t, expected[key], v)
+		return nil
+	}))
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, len(expected), len(keys))
+
+	for key, v := range expected {
+		got, exists, err := s.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, v, got)
+	}
+	_, exists, _ := s.Get("missing")
+	assert.False(t, exists)
+
+	for key := range expected {
+		assert.Nil(t, s.Delete(key))
+	}
+	assert.Nil(t, s.root)
+	assert.Equal(t, 0, s.Len())
+}
@@ -0,0 +1,103 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var ErrZstdUnsupported = errors.New("zstd compressed input is not supported, decompress it with zstd -d first")
+
+func detectCompression(magic []byte) (compressed bool, err error) {
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return true, nil
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		return false, ErrZstdUnsupported
+	}
+	if bytes.HasPrefix(magic, encMagic[:len(zstdMagic)]) {
+		return false, ErrEncrypted
+	}
+	return false, nil
+}
+
+// Decompress detects gzip input from its magic bytes and returns a reader of the uncompressed stream.
+// Any other input is returned as is.
+func Decompress(rd io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(rd)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	compressed, err := detectCompression(magic)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if ferr := g.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// OpenFile opens the named AOF file, decompressing it on the fly if it is gzipped.
+// Uncompressed files are returned as the *os.File itself, so they stay seekable.
+func OpenFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+
+	compressed, err := detectCompression(magic[:n])
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !compressed {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, f: f}, nil
+}
+
+// NewCompressWriter returns a writer that gzips everything written to w; Close flushes it.
+func NewCompressWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
@@ -0,0 +1,82 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := NewCompressWriter(&buf)
+	_, err := io.WriteString(w, data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	data := "1\nkey1 0\nCREATE key1 1\n"
+
+	tests := []struct {
+		input []byte
+		err   error
+	}{
+		{input: []byte(data)},
+		{input: gzipped(t, data)},
+		{input: []byte{}},
+		{input: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, err: ErrZstdUnsupported},
+	}
+
+	for i, test := range tests {
+		rd, err := Decompress(bytes.NewReader(test.input))
+		if test.err != nil {
+			assert.Equal(t, test.err, err)
+			continue
+		}
+		assert.Nil(t, err)
+
+		out, err := ioutil.ReadAll(rd)
+		assert.Nil(t, err)
+		if len(test.input) > 0 {
+			assert.Equal(t, data, string(out), "test %d", i)
+		} else {
+			assert.Empty(t, out)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the error is in the 4th line of the uncompressed content
+	data := "1\nkey1 1\nCREATE key1 1\nSET key2 2\n"
+	plain, compressed := filepath.Join(dir, "plain.aof"), filepath.Join(dir, "compressed.aof.gz")
+	assert.Nil(t, ioutil.WriteFile(plain, []byte(data), 0644))
+	assert.Nil(t, ioutil.WriteFile(compressed, gzipped(t, data), 0644))
+
+	for _, name := range []string{plain, compressed} {
+		f, err := OpenFile(name)
+		assert.Nil(t, err)
+
+		_, err = ReadState(f)
+		assert.EqualError(t, err, "ERROR at line 4: Key 'key2' was not defined in the header")
+		assert.Nil(t, f.Close())
+	}
+
+	f, err := OpenFile(plain)
+	assert.Nil(t, err)
+	_, seekable := f.(io.Seeker)
+	assert.True(t, seekable)
+	f.Close()
+
+	_, err = OpenFile(filepath.Join(dir, "missing.aof"))
+	assert.NotNil(t, err)
+}
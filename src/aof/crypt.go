@@ -0,0 +1,245 @@
+package aof
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// An encrypted AOF starts with the magic bytes and a random salt, followed by
+// chunks of at most encChunkSize plaintext bytes:
+//
+//	flag (1 byte) | plaintext length (4 bytes, big endian) | AES-GCM ciphertext and tag
+//
+// Every file derives its own key from the master key and the salt. The nonce of a
+// chunk is its 11-byte sequence number followed by the flag, so a reordered,
+// dropped or truncated chunk fails authentication.
+const (
+	encChunkSize  = 64 * 1024
+	encSaltSize   = 16
+	encFlagMore   = 0
+	encFlagFinal  = 1
+	encKeySize    = 32
+	encRecordSize = 5
+)
+
+var encMagic = []byte("AOFENC\x00\x01")
+
+var (
+	ErrEncrypted            = errors.New("AOF file is encrypted, a key is required")
+	ErrNotEncrypted         = errors.New("AOF file is not encrypted")
+	ErrTampered             = errors.New("AOF chunk authentication failed: the file was tampered with, reordered or the key is wrong")
+	ErrTruncated            = errors.New("Encrypted AOF file is truncated")
+	ErrInvalidEncryptionKey = errors.New("Encryption key must be 32 bytes, raw or hex encoded")
+)
+
+// LoadKey reads a 32-byte encryption key from a file, or from an environment
+// variable when spec has the form env:NAME. The key may be hex encoded.
+func LoadKey(spec string) ([]byte, error) {
+	var raw []byte
+	if strings.HasPrefix(spec, "env:") {
+		name := spec[len("env:"):]
+		val, exists := os.LookupEnv(name)
+		if !exists {
+			return nil, errors.New("Environment variable is not set: " + name)
+		}
+		raw = []byte(val)
+	} else {
+		var err error
+		raw, err = ioutil.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(raw) == encKeySize {
+		return raw, nil
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == hex.EncodedLen(encKeySize) {
+		key, err := hex.DecodeString(string(trimmed))
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, ErrInvalidEncryptionKey
+}
+
+func newFileCipher(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != encKeySize {
+		return nil, ErrInvalidEncryptionKey
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encMagic)
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(seq uint64, flag byte) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], seq)
+	nonce[11] = flag
+	return nonce
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	seq    uint64
+	closed bool
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to w.
+// Close writes the final chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newFileCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(append([]byte{}, encMagic...), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *encryptWriter) writeChunk(flag byte) error {
+	record := make([]byte, encRecordSize, encRecordSize+len(e.buf)+e.aead.Overhead())
+	record[0] = flag
+	binary.BigEndian.PutUint32(record[1:], uint32(len(e.buf)))
+
+	record = e.aead.Seal(record, chunkNonce(e.seq, flag), e.buf, record[:encRecordSize])
+	e.seq++
+	e.buf = e.buf[:0]
+
+	_, err := e.w.Write(record)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	if e.closed {
+		return 0, ErrWriterClosed
+	}
+
+	for len(p) > 0 {
+		if len(e.buf) == encChunkSize {
+			if err := e.writeChunk(encFlagMore); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return ErrWriterClosed
+	}
+	e.closed = true
+	return e.writeChunk(encFlagFinal)
+}
+
+type decryptReader struct {
+	rd    io.Reader
+	aead  cipher.AEAD
+	seq   uint64
+	plain []byte
+	final bool
+	err   error
+}
+
+// NewDecryptReader returns a reader that decrypts and authenticates rd chunk by chunk
+func NewDecryptReader(rd io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, len(encMagic)+encSaltSize)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return nil, ErrNotEncrypted
+	}
+
+	aead, err := newFileCipher(key, header[len(encMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{rd: rd, aead: aead}, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	record := make([]byte, encRecordSize)
+	if _, err := io.ReadFull(d.rd, record); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	flag, size := record[0], binary.BigEndian.Uint32(record[1:])
+	if (flag != encFlagMore && flag != encFlagFinal) || size > encChunkSize {
+		return ErrTampered
+	}
+
+	ciphertext := make([]byte, int(size)+d.aead.Overhead())
+	if _, err := io.ReadFull(d.rd, ciphertext); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	plain, err := d.aead.Open(ciphertext[:0], chunkNonce(d.seq, flag), ciphertext, record)
+	if err != nil {
+		return ErrTampered
+	}
+	d.seq++
+	d.plain = plain
+
+	if flag == encFlagFinal {
+		d.final = true
+		if n, _ := d.rd.Read(make([]byte, 1)); n > 0 {
+			return ErrTampered
+		}
+	}
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		d.err = d.readChunk()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package aof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, encKeySize)
+
+func encrypted(t *testing.T, data string, key []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+// chunkOffsets returns the offsets of the chunk records of an encrypted file
+func chunkOffsets(data []byte) []int {
+	offsets := []int{}
+	for off := len(encMagic) + encSaltSize; off < len(data); {
+		offsets = append(offsets, off)
+		off += encRecordSize + int(binary.BigEndian.Uint32(data[off+1:])) + 16
+	}
+	return offsets
+}
+
+func largeAOF(keys int) string {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < keys; i++ {
+		w.Create(fmt.Sprintf("key%d", i), i)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := largeAOF(20000)
+	assert.True(t, len(data) > 2*encChunkSize)
+
+	for _, input := range []string{"", "1\nkey1 0\nCREATE key1 1\n", data} {
+		rd, err := NewDecryptReader(bytes.NewReader(encrypted(t, input, testKey)), testKey)
+		assert.Nil(t, err)
+		plain, err := ioutil.ReadAll(rd)
+		assert.Nil(t, err)
+		assert.Equal(t, input, string(plain))
+	}
+
+	rd, err := NewDecryptReader(bytes.NewReader(encrypted(t, data, testKey)), testKey)
+	assert.Nil(t, err)
+	states, err := ReadState(rd)
+	assert.Nil(t, err)
+	assert.Equal(t, 20000, len(states))
+}
+
+func TestDecryptTampered(t *testing.T) {
+	valid := encrypted(t, largeAOF(20000), testKey)
+	offsets := chunkOffsets(valid)
+	assert.True(t, len(offsets) >= 3)
+
+	flipped := append([]byte{}, valid...)
+	flipped[offsets[1]+encRecordSize+10] ^= 1
+
+	// swap the first two chunks, both are full-sized
+	reordered := append([]byte{}, valid[:offsets[0]]...)
+	reordered = append(reordered, valid[offsets[1]:offsets[2]]...)
+	reordered = append(reordered, valid[offsets[0]:offsets[1]]...)
+	reordered = append(reordered, valid[offsets[2]:]...)
+
+	final := append([]byte{}, valid...)
+	final[offsets[0]] = encFlagFinal
+
+	tests := []struct {
+		data []byte
+		key  []byte
+		err  error
+	}{
+		{data: flipped, key: testKey, err: ErrTampered},
+		{data: reordered, key: testKey, err: ErrTampered},
+		{data: final, key: testKey, err: ErrTampered},
+		{data: valid[:offsets[len(offsets)-1]], key: testKey, err: ErrTruncated},
+		{data: valid[:len(valid)-1], key: testKey, err: ErrTruncated},
+		{data: append(append([]byte{}, valid...), 'x'), key: testKey, err: ErrTampered},
+		{data: valid, key: bytes.Repeat([]byte{0x43}, encKeySize), err: ErrTampered},
+	}
+
+	for i, test := range tests {
+		rd, err := NewDecryptReader(bytes.NewReader(test.data), test.key)
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(rd)
+		assert.Equal(t, test.err, err, "test %d", i)
+	}
+
+	_, err := NewDecryptReader(strings.NewReader("1\nkey1 0\nCREATE key1 1\n"), testKey)
+	assert.Equal(t, ErrNotEncrypted, err)
+
+	_, err = NewEncryptWriter(&bytes.Buffer{}, []byte("short"))
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+
+	// the parser reports tampering through its error
+	rd, _ := NewDecryptReader(bytes.NewReader(flipped), testKey)
+	_, err = ReadState(rd)
+	assert.Contains(t, err.Error(), ErrTampered.Error())
+
+	_, err = Decompress(bytes.NewReader(valid))
+	assert.Equal(t, ErrEncrypted, err)
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hexFile, rawFile, badFile := filepath.Join(dir, "hex.key"), filepath.Join(dir, "raw.key"), filepath.Join(dir, "bad.key")
+	ioutil.WriteFile(hexFile, []byte(hex.EncodeToString(testKey)+"\n"), 0600)
+	ioutil.WriteFile(rawFile, testKey, 0600)
+	ioutil.WriteFile(badFile, []byte("secret"), 0600)
+	os.Setenv("AOF_TEST_KEY", hex.EncodeToString(testKey))
+	defer os.Unsetenv("AOF_TEST_KEY")
+
+	for _, spec := range []string{hexFile, rawFile, "env:AOF_TEST_KEY"} {
+		key, err := LoadKey(spec)
+		assert.Nil(t, err)
+		assert.Equal(t, testKey, key)
+	}
+
+	_, err = LoadKey(badFile)
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+	_, err = LoadKey("env:AOF_TEST_KEY_MISSING")
+	assert.NotNil(t, err)
+	_, err = LoadKey(filepath.Join(dir, "missing.key"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,479 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells when appended records are synced to the disk
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // every update waits for a sync, concurrent updates share one
+	SyncEverySec                   // a background sync every second
+	SyncNo                         // the operating system decides, Close syncs
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "everysec":
+		return SyncEverySec, nil
+	case "no":
+		return SyncNo, nil
+	}
+	return SyncAlways, fmt.Errorf("Unknown sync policy: %s", s)
+}
+
+type DBOption func(*DB)
+
+func WithSync(policy SyncPolicy) DBOption {
+	return func(db *DB) {
+		db.policy = policy
+	}
+}
+
+// dbFile is the part of *os.File the database appends to
+type dbFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// withFile wraps the opened file, tests use it to inject faults
+func withFile(wrap func(*os.File) dbFile) DBOption {
+	return func(db *DB) {
+		db.wrap = wrap
+	}
+}
+
+// withClock replaces the clock of the database
+func withClock(now func() time.Time) DBOption {
+	return func(db *DB) {
+		db.now = now
+	}
+}
+
+// withTicker replaces the ticker of the everysec policy, tests use it to sync on demand
+func withTicker(tick <-chan time.Time) DBOption {
+	return func(db *DB) {
+		db.tick = tick
+	}
+}
+
+var (
+	ErrDBClosed       = errors.New("AOF database is closed")
+	ErrDBChecksummed  = errors.New("AOF database cannot append to a checksummed file")
+	ErrDBInconsistent = errors.New("AOF database failed to write a record, reopen it to recover")
+)
+
+// DB is a key-value store kept in a footer-indexed AOF file. Every update is
+// appended to the file and synced as the sync policy says, and the footer is
+// written by Close. A file left without its footer is recovered by Open.
+type DB struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	file   dbFile
+	wrap   func(*os.File) dbFile
+	w      *Writer
+	values map[string]value
+	err    error
+	closed bool
+
+	multiPart bool
+	manifest  *Manifest
+	segSize   int64 // bytes of the files of the manifest before the appended one
+	segLines  int
+
+	live        int // keys that are not deleted
+	rewriting   bool
+	rewriteBuf  []dbRecord // updates that arrived during a rewrite
+	rewriteDone chan struct{}
+	autoRewrite RewritePolicy
+	stats       DBStats
+	now         func() time.Time
+
+	rewriteFailures int       // failed rewrites in a row
+	rewriteRetry    time.Time // no automatic rewrite starts before
+
+	policy   SyncPolicy
+	tick     <-chan time.Time
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	written  uint64 // updates appended to the file
+	synced   uint64 // updates known to be on the disk
+	syncing  bool
+	syncErr  error
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// Open replays the AOF file at path, creating it if needed, and prepares it for appending
+func Open(path string, opts ...DBOption) (*DB, error) {
+	db := &DB{
+		path:   path,
+		values: make(map[string]value),
+		wrap:   func(f *os.File) dbFile { return f },
+		now:    time.Now,
+	}
+	db.syncCond = sync.NewCond(&db.syncMu)
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	name := path
+	if db.multiPart {
+		var err error
+		if name, err = db.openManifest(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.f = f
+
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.stats.BaseSize, _ = db.size()
+
+	if db.policy == SyncEverySec {
+		db.stop, db.stopped = make(chan struct{}), make(chan struct{})
+		go db.syncEverySec()
+	}
+	return db, nil
+}
+
+func (db *DB) load() error {
+	offset, err := checkFooter(db.f)
+	if err != nil {
+		if err := recoverFooter(db.f); err != nil {
+			return err
+		}
+		stat, err := db.f.Stat()
+		if err != nil {
+			return err
+		}
+		if stat.Size() == 0 {
+			offset = 0
+		} else if offset, err = checkFooter(db.f); err != nil {
+			return err
+		}
+	}
+
+	keys := []string{}
+	lastLines := make(map[string]int)
+	lineCount := 0
+	if offset > 0 {
+		if _, err := db.f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if keys, lastLines, err = readFooterIndex(bufio.NewReader(db.f)); err != nil {
+			return err
+		}
+		for _, lastLine := range lastLines {
+			if lastLine >= lineCount {
+				lineCount = lastLine + 1
+			}
+		}
+	}
+
+	lines, err := db.replay(offset > 0)
+	if err != nil {
+		return err
+	}
+	db.segLines = lines - lineCount
+
+	// drop the footer, Close writes a new one
+	if err := db.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := db.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	db.file = db.wrap(db.f)
+	// replay rejects a checksummed file
+	db.w = resumeFooterWriter(db.file, offset, keys, lastLines, lineCount, false, 0)
+	return nil
+}
+
+// replay loads the values from the file, or from all the files of the manifest,
+// and returns the number of body lines. appended tells whether the file that
+// is appended to has any content.
+func (db *DB) replay(appended bool) (int, error) {
+	var p *AOFParser
+	if db.manifest != nil {
+		var err error
+		if p, err = NewManifestParser(db.path); err != nil {
+			return 0, err
+		}
+	} else if appended {
+		// the parser gets its own handle, its lexer may still read after the replay
+		rd, err := os.Open(db.path)
+		if err != nil {
+			return 0, err
+		}
+		defer rd.Close()
+		p = NewAOFParser(rd)
+	} else {
+		return 0, nil
+	}
+
+	lines := 0
+	err := replay(p, func(event Event) error {
+		db.values[event.Key] = value{val: event.Value, deleted: event.Deleted}
+		lines = event.Line + 1
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range db.values {
+		if !v.deleted {
+			db.live++
+		}
+	}
+
+	// the appended file is the last one the parser read
+	if appended && !p.indexed {
+		return 0, ErrNotFooterIndexed
+	}
+	if appended && p.checksums {
+		return 0, ErrDBChecksummed
+	}
+	return lines, nil
+}
+
+// size returns the bytes and the body lines of all the files of the database
+func (db *DB) size() (int64, int) {
+	return db.segSize + db.w.offset, db.segLines + db.w.lineCount
+}
+
+// Get returns the value of a key and whether the key exists
+func (db *DB) Get(key string) (int, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v, exists := db.values[key]
+	if !exists || v.deleted {
+		return 0, false
+	}
+	return v.val, true
+}
+
+func (db *DB) Create(key string, value int) error {
+	return db.update(EventCreate, key, value)
+}
+
+func (db *DB) Set(key string, value int) error {
+	return db.update(EventSet, key, value)
+}
+
+func (db *DB) Modify(key string, delta int) error {
+	return db.update(EventModify, key, delta)
+}
+
+func (db *DB) Delete(key string) error {
+	return db.update(EventDelete, key, 0)
+}
+
+func (db *DB) update(typ EventType, key string, arg int) error {
+	seq, err := db.apply(typ, key, arg)
+	if err != nil || db.policy != SyncAlways {
+		return err
+	}
+	return db.waitSync(seq)
+}
+
+// apply appends an update to the file and applies it to the state.
+// It returns the sequence number of the update to wait for its sync.
+func (db *DB) apply(typ EventType, key string, arg int) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+	if db.err != nil {
+		return 0, db.err
+	}
+
+	db.syncMu.Lock()
+	err := db.syncErr
+	db.syncMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+
+	v, exists := db.values[key]
+	v, err = applyEvent(typ, key, arg, v, exists)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := db.append(typ, key, arg); err != nil {
+		// the file may end with a partial record now
+		db.err = ErrDBInconsistent
+		return 0, err
+	}
+	if exists && !db.values[key].deleted {
+		db.live--
+	}
+	if !v.deleted {
+		db.live++
+	}
+	db.values[key] = v
+
+	db.syncMu.Lock()
+	db.written++
+	seq := db.written
+	db.syncMu.Unlock()
+
+	if db.rewriting {
+		if db.manifest == nil {
+			db.rewriteBuf = append(db.rewriteBuf, dbRecord{typ: typ, key: key, arg: arg})
+		}
+	} else if db.needsRewrite() {
+		if _, err := db.startRewrite(); err != nil {
+			db.rewriteFailed(err)
+		}
+	}
+	return seq, nil
+}
+
+func (db *DB) append(typ EventType, key string, arg int) error {
+	if err := db.w.writeEvent(typ, key, arg); err != nil {
+		return err
+	}
+	return db.w.Flush()
+}
+
+// waitSync returns once the update seq is on the disk. The first waiter syncs
+// everything appended so far, the others wait for it: a group commit.
+func (db *DB) waitSync(seq uint64) error {
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+
+	for db.synced < seq {
+		if db.syncErr != nil {
+			return db.syncErr
+		}
+		if db.syncing {
+			db.syncCond.Wait()
+			continue
+		}
+
+		db.syncing = true
+		target := db.written
+		db.syncMu.Unlock()
+		err := db.file.Sync()
+		db.syncMu.Lock()
+		db.syncing = false
+
+		if err != nil {
+			// the state of the unsynced records is unknown, stop accepting updates
+			db.syncErr = err
+		} else {
+			db.synced = target
+		}
+		db.syncCond.Broadcast()
+	}
+	return nil
+}
+
+func (db *DB) syncEverySec() {
+	defer close(db.stopped)
+
+	tick := db.tick
+	if tick == nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-tick:
+			db.syncMu.Lock()
+			seq := db.written
+			db.syncMu.Unlock()
+			db.waitSync(seq)
+		}
+	}
+}
+
+// Close writes the footer and closes the file
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	db.closed = true
+	rewriteDone := db.rewriteDone
+	db.mu.Unlock()
+
+	// a running rewrite gives up once it sees the database is closed
+	if rewriteDone != nil {
+		<-rewriteDone
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.stop != nil {
+		close(db.stop)
+		<-db.stopped
+	}
+
+	// keep the waiters of a group commit off the file, the final sync covers them
+	db.syncMu.Lock()
+	for db.syncing {
+		db.syncCond.Wait()
+	}
+	db.syncing = true
+	err := db.syncErr
+	db.syncMu.Unlock()
+
+	if err == nil {
+		err = db.err
+	}
+	if err == nil {
+		err = db.w.Close()
+		if err == nil {
+			err = db.file.Sync()
+		}
+	}
+
+	db.syncMu.Lock()
+	db.syncing = false
+	if err == nil {
+		db.synced = db.written
+	} else if db.syncErr == nil {
+		db.syncErr = err
+	}
+	db.syncCond.Broadcast()
+	db.syncMu.Unlock()
+
+	if cerr := db.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
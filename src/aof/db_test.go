@@ -0,0 +1,346 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDB(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "db.aof")
+
+	db, err := Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key1", 10))
+	assert.Nil(t, db.Create("key2", 20))
+	assert.Nil(t, db.Modify("key1", 5))
+	assert.Nil(t, db.Set("key2", 25))
+	assert.Nil(t, db.Delete("key2"))
+
+	assert.EqualError(t, db.Create("key1", 1), "Key 'key1' has already been created")
+	assert.EqualError(t, db.Set("key3", 1), "Key 'key3' was not created")
+	assert.EqualError(t, db.Modify("key2", 1), "Key 'key2' was not created")
+	assert.EqualError(t, db.Delete("key2"), "Key 'key2' has been deleted")
+	assert.Equal(t, ErrInvalidKey, db.Create("key 3", 1))
+
+	v, exists := db.Get("key1")
+	assert.Equal(t, 15, v)
+	assert.True(t, exists)
+	_, exists = db.Get("key2")
+	assert.False(t, exists)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, ErrDBClosed, db.Set("key1", 1))
+	assert.Equal(t, ErrDBClosed, db.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `FOOTER
+CREATE key1 10
+CREATE key2 20
+MODIFY key1 +5
+SET key2 25
+DELETE key2
+INDEX 2
+key1 2
+key2 4
+76
+`, string(data))
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	v, _ = db.Get("key1")
+	assert.Equal(t, 15, v)
+	assert.Nil(t, db.Create("key2", 1))
+	assert.Nil(t, db.Close())
+
+	states, err := ReadState(openTestFile(t, path))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "key1", Value: 15, FirstLine: 0, LastLine: 2, UpdateCount: 2},
+		{Key: "key2", Value: 1, FirstLine: 1, LastLine: 5, UpdateCount: 4},
+	}, states)
+}
+
+func openTestFile(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	return f
+}
+
+func TestDBRecover(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		data   string
+		values map[string]int
+	}{
+		{data: "", values: map[string]int{}},
+		{data: "FOO", values: map[string]int{}},
+		{data: "FOOTER\n", values: map[string]int{}},
+		{data: "FOOTER\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +1\n", values: map[string]int{"key1": 2, "key2": 2}},
+		{data: "FOOTER\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +1", values: map[string]int{"key1": 1, "key2": 2}},
+		{data: "FOOTER\nCREATE key1 1\nINDEX 1\nkey1 0\n2", values: map[string]int{"key1": 1}},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, "recover.aof")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(test.data), 0644))
+
+		db, err := Open(path)
+		if !assert.Nil(t, err, "test %d", i) {
+			continue
+		}
+		for key, expected := range test.values {
+			v, exists := db.Get(key)
+			assert.True(t, exists, "test %d", i)
+			assert.Equal(t, expected, v, "test %d", i)
+		}
+
+		assert.Nil(t, db.Create("new", 1))
+		assert.Nil(t, db.Close())
+
+		states, err := ReadState(openTestFile(t, path))
+		assert.Nil(t, err, "test %d", i)
+		assert.Equal(t, len(test.values)+1, len(states), "test %d", i)
+	}
+
+	// a writer that stopped before Close
+	path := filepath.Join(dir, "crash.aof")
+	db, err := Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key1", 1))
+	assert.Nil(t, db.Modify("key1", 1))
+	db.f.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	v, _ := db.Get("key1")
+	assert.Equal(t, 2, v)
+	assert.Nil(t, db.Close())
+}
+
+func TestDBOpenErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{data: "1\nkey1 0\nCREATE key1 1\n", err: ErrNotFooterIndexed.Error()},
+		{data: "FOOTER\nSET key1 1\nINDEX 1\nkey1 0\n7\n", err: "ERROR at line 2: Key 'key1' was not created"},
+		{data: "FOOTER\nCREATE key1 1 #00000000\n", err: "ERROR at line 2: Checksum mismatch: #00000000"},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, "invalid.aof")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(test.data), 0644))
+
+		_, err := Open(path)
+		if assert.NotNil(t, err, "test %d", i) {
+			assert.Equal(t, test.err, err.Error(), "test %d", i)
+		}
+	}
+}
+
+var errPowerLoss = errors.New("power loss")
+
+// faultyFile loses the power after a number of writes: the last write is torn
+// and everything after fails. Syncs are counted and can be slowed down.
+type faultyFile struct {
+	mu        sync.Mutex
+	f         *os.File
+	writes    int
+	failAfter int
+	crashed   bool
+	written   int64
+	synced    int64
+	syncs     int
+	syncDelay time.Duration
+}
+
+func (ff *faultyFile) Write(p []byte) (int, error) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	if ff.crashed {
+		return 0, errPowerLoss
+	}
+
+	ff.writes++
+	if ff.failAfter > 0 && ff.writes >= ff.failAfter {
+		ff.crashed = true
+		n, _ := ff.f.Write(p[:len(p)/2])
+		ff.written += int64(n)
+		return n, errPowerLoss
+	}
+
+	n, err := ff.f.Write(p)
+	ff.written += int64(n)
+	return n, err
+}
+
+func (ff *faultyFile) Sync() error {
+	ff.mu.Lock()
+	if ff.crashed {
+		ff.mu.Unlock()
+		return errPowerLoss
+	}
+	// a sync covers the writes that completed before it started
+	written := ff.written
+	ff.mu.Unlock()
+
+	time.Sleep(ff.syncDelay)
+	err := ff.f.Sync()
+
+	ff.mu.Lock()
+	ff.syncs++
+	if err == nil && written > ff.synced {
+		ff.synced = written
+	}
+	ff.mu.Unlock()
+	return err
+}
+
+func (ff *faultyFile) Close() error {
+	return ff.f.Close()
+}
+
+// crash drops a part of the data that was written but never synced
+func (ff *faultyFile) crash(t *testing.T, path string) {
+	ff.f.Close()
+	assert.Nil(t, os.Truncate(path, ff.synced+(ff.written-ff.synced)/2))
+}
+
+func TestDBSyncAlwaysCrash(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "crash.aof")
+
+	const workers = 8
+	ff := &faultyFile{failAfter: 300}
+	db, err := Open(path, WithSync(SyncAlways), withFile(func(f *os.File) dbFile {
+		ff.f = f
+		return ff
+	}))
+	assert.Nil(t, err)
+
+	for i := 0; i < workers; i++ {
+		assert.Nil(t, db.Create(fmt.Sprintf("key%d", i), 0))
+	}
+
+	acked := make([]int, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if db.Modify(fmt.Sprintf("key%d", i), 1) != nil {
+					return
+				}
+				acked[i]++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, ff.crashed)
+	ff.crash(t, path)
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	for i := 0; i < workers; i++ {
+		v, exists := db.Get(fmt.Sprintf("key%d", i))
+		assert.True(t, exists)
+		// no acknowledged write is lost, the one in flight may have made it
+		assert.True(t, v == acked[i] || v == acked[i]+1, "key%d: %d acknowledged, %d recovered", i, acked[i], v)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDBGroupCommit(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	const workers, updates = 8, 10
+	ff := &faultyFile{syncDelay: 5 * time.Millisecond}
+	db, err := Open(filepath.Join(dir, "group.aof"), withFile(func(f *os.File) dbFile {
+		ff.f = f
+		return ff
+	}))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			assert.Nil(t, db.Create(key, 0))
+			for j := 1; j < updates; j++ {
+				assert.Nil(t, db.Modify(key, 1))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, ff.written, ff.synced)
+	assert.True(t, ff.syncs < workers*updates, "%d syncs for %d updates", ff.syncs, workers*updates)
+	assert.Nil(t, db.Close())
+}
+
+func TestDBSyncPolicies(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for _, policy := range []SyncPolicy{SyncEverySec, SyncNo} {
+		ff := &faultyFile{}
+		tick := make(chan time.Time)
+		db, err := Open(filepath.Join(dir, fmt.Sprintf("policy%d.aof", policy)), WithSync(policy), withTicker(tick), withFile(func(f *os.File) dbFile {
+			ff.f = f
+			return ff
+		}))
+		assert.Nil(t, err)
+
+		assert.Nil(t, db.Create("key1", 1))
+		ff.mu.Lock()
+		assert.Equal(t, 0, ff.syncs)
+		ff.mu.Unlock()
+
+		if policy == SyncEverySec {
+			// the second tick is received once the sync of the first one is done
+			tick <- time.Time{}
+			tick <- time.Time{}
+			ff.mu.Lock()
+			assert.Equal(t, ff.written, ff.synced)
+			ff.mu.Unlock()
+		}
+
+		assert.Nil(t, db.Close())
+		assert.Equal(t, ff.written, ff.synced)
+	}
+
+	for _, s := range []string{"always", "everysec", "no"} {
+		_, err := ParseSyncPolicy(s)
+		assert.Nil(t, err)
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	assert.EqualError(t, err, "Unknown sync policy: sometimes")
+}
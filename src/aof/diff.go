@@ -0,0 +1,288 @@
+package aof
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DiffKind tells how the final state of a key differs between two AOFs. A
+// deleted key and a key that is never used have no value, they do not differ.
+type DiffKind int
+
+const (
+	DiffOnlyA    DiffKind = iota // live in A, never used in B
+	DiffOnlyB                    // never used in A, live in B
+	DiffChanged                  // live in both with different values
+	DiffDeletedA                 // deleted in A, live in B
+	DiffDeletedB                 // live in A, deleted in B
+)
+
+var diffKindNames = map[DiffKind]string{
+	DiffOnlyA:    "only_a",
+	DiffOnlyB:    "only_b",
+	DiffChanged:  "changed",
+	DiffDeletedA: "deleted_a",
+	DiffDeletedB: "deleted_b",
+}
+
+func (k DiffKind) String() string {
+	return diffKindNames[k]
+}
+
+type DiffFormat int
+
+const (
+	DiffText DiffFormat = iota
+	DiffJSON
+	DiffUnified // unified diff of the sorted "key value" lines of the live keys
+)
+
+func ParseDiffFormat(s string) (DiffFormat, error) {
+	switch s {
+	case "text":
+		return DiffText, nil
+	case "json":
+		return DiffJSON, nil
+	case "unified":
+		return DiffUnified, nil
+	}
+	return DiffText, fmt.Errorf("Unknown diff format: %s", s)
+}
+
+// KeyDiff is a key whose final state differs. A and B are 0 where the key is not live.
+type KeyDiff struct {
+	Key  string
+	Kind DiffKind
+	A    int
+	B    int
+}
+
+// StateDiff holds the differences between the final states of two AOFs
+type StateDiff struct {
+	Keys  []KeyDiff // sorted by key
+	liveA map[string]int
+	liveB map[string]int
+}
+
+func liveStates(rd io.Reader) (map[string]int, map[string]bool, error) {
+	states, err := ReadState(rd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	live := make(map[string]int)
+	deleted := make(map[string]bool)
+	for _, s := range states {
+		if s.Deleted {
+			deleted[s.Key] = true
+		} else {
+			live[s.Key] = s.Value
+		}
+	}
+	return live, deleted, nil
+}
+
+// Diff replays both AOFs and compares the final states of their keys
+func Diff(a, b io.Reader) (*StateDiff, error) {
+	liveA, deletedA, err := liveStates(a)
+	if err != nil {
+		return nil, fmt.Errorf("A: %v", err)
+	}
+	liveB, deletedB, err := liveStates(b)
+	if err != nil {
+		return nil, fmt.Errorf("B: %v", err)
+	}
+
+	d := &StateDiff{Keys: []KeyDiff{}, liveA: liveA, liveB: liveB}
+	for key, va := range liveA {
+		vb, inB := liveB[key]
+		switch {
+		case inB && va != vb:
+			d.Keys = append(d.Keys, KeyDiff{Key: key, Kind: DiffChanged, A: va, B: vb})
+		case deletedB[key]:
+			d.Keys = append(d.Keys, KeyDiff{Key: key, Kind: DiffDeletedB, A: va})
+		case !inB:
+			d.Keys = append(d.Keys, KeyDiff{Key: key, Kind: DiffOnlyA, A: va})
+		}
+	}
+	for key, vb := range liveB {
+		if _, inA := liveA[key]; inA {
+			continue
+		} else if deletedA[key] {
+			d.Keys = append(d.Keys, KeyDiff{Key: key, Kind: DiffDeletedA, B: vb})
+		} else {
+			d.Keys = append(d.Keys, KeyDiff{Key: key, Kind: DiffOnlyB, B: vb})
+		}
+	}
+
+	sort.Sort(diffsByKey(d.Keys))
+	return d, nil
+}
+
+type diffsByKey []KeyDiff
+
+func (s diffsByKey) Len() int           { return len(s) }
+func (s diffsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s diffsByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+// Write writes the differences in the format; nameA and nameB label the inputs
+// of a unified diff
+func (d *StateDiff) Write(w io.Writer, format DiffFormat, nameA, nameB string) error {
+	switch format {
+	case DiffText:
+		return d.writeText(w)
+	case DiffJSON:
+		return d.writeJSON(w)
+	case DiffUnified:
+		return d.writeUnified(w, nameA, nameB)
+	}
+	return fmt.Errorf("Unknown diff format: %d", format)
+}
+
+func (d *StateDiff) writeText(w io.Writer) error {
+	for _, k := range d.Keys {
+		var err error
+		switch k.Kind {
+		case DiffOnlyA:
+			_, err = fmt.Fprintf(w, "%s: only in A (%d)\n", k.Key, k.A)
+		case DiffOnlyB:
+			_, err = fmt.Fprintf(w, "%s: only in B (%d)\n", k.Key, k.B)
+		case DiffChanged:
+			_, err = fmt.Fprintf(w, "%s: %d -> %d\n", k.Key, k.A, k.B)
+		case DiffDeletedA:
+			_, err = fmt.Fprintf(w, "%s: deleted in A (B: %d)\n", k.Key, k.B)
+		case DiffDeletedB:
+			_, err = fmt.Fprintf(w, "%s: deleted in B (A: %d)\n", k.Key, k.A)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type jsonKeyDiff struct {
+	Key    string `json:"key"`
+	Change string `json:"change"`
+	A      *int   `json:"a,omitempty"`
+	B      *int   `json:"b,omitempty"`
+}
+
+func (d *StateDiff) writeJSON(w io.Writer) error {
+	diffs := make([]jsonKeyDiff, 0, len(d.Keys))
+	for i := range d.Keys {
+		k := &d.Keys[i]
+		jd := jsonKeyDiff{Key: k.Key, Change: k.Kind.String()}
+		if k.Kind != DiffOnlyB && k.Kind != DiffDeletedA {
+			jd.A = &k.A
+		}
+		if k.Kind != DiffOnlyA && k.Kind != DiffDeletedB {
+			jd.B = &k.B
+		}
+		diffs = append(diffs, jd)
+	}
+	return json.NewEncoder(w).Encode(diffs)
+}
+
+func sortedKeys(values map[string]int) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hunkRange formats the range of a hunk like diff -u, an empty range starts at the line before it
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeUnified writes a unified diff without context lines of the live keys of both states
+func (d *StateDiff) writeUnified(w io.Writer, nameA, nameB string) error {
+	if len(d.Keys) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB); err != nil {
+		return err
+	}
+
+	keysA, keysB := sortedKeys(d.liveA), sortedKeys(d.liveB)
+	i, j := 0, 0
+	startA, startB := 0, 0
+	removed, added := []string{}, []string{}
+
+	flush := func() error {
+		if len(removed) == 0 && len(added) == 0 {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(startA, len(removed)), hunkRange(startB, len(added)))
+		for _, line := range removed {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "-%s\n", line)
+			}
+		}
+		for _, line := range added {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "+%s\n", line)
+			}
+		}
+		removed, added = removed[:0], added[:0]
+		return err
+	}
+
+	for i < len(keysA) || j < len(keysB) {
+		inA := i < len(keysA) && (j == len(keysB) || keysA[i] <= keysB[j])
+		inB := j < len(keysB) && (i == len(keysA) || keysB[j] <= keysA[i])
+		if inA && inB && d.liveA[keysA[i]] == d.liveB[keysB[j]] {
+			if err := flush(); err != nil {
+				return err
+			}
+			i++
+			j++
+			continue
+		}
+
+		if len(removed) == 0 && len(added) == 0 {
+			startA, startB = i, j
+		}
+		if inA {
+			removed = append(removed, fmt.Sprintf("%s %d", keysA[i], d.liveA[keysA[i]]))
+			i++
+		}
+		if inB {
+			added = append(added, fmt.Sprintf("%s %d", keysB[j], d.liveB[keysB[j]]))
+			j++
+		}
+	}
+	return flush()
+}
+
+// WritePatch writes the records that turn the state of A into the state of B
+// to w. Applied as the tail of a snapshot of A, like CompactTail does, they
+// give the state of B. The caller closes w.
+func (d *StateDiff) WritePatch(w *Writer) error {
+	for _, k := range d.Keys {
+		var err error
+		switch k.Kind {
+		case DiffOnlyA, DiffDeletedB:
+			err = w.Delete(k.Key)
+		case DiffOnlyB, DiffDeletedA:
+			err = w.Create(k.Key, k.B)
+		case DiffChanged:
+			err = w.Set(k.Key, k.B)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
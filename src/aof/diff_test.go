@@ -0,0 +1,72 @@
+package aof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	var a, b bytes.Buffer
+	w := NewWriter(&a)
+	w.Create("same", 1)
+	w.Create("changed", 2)
+	w.Create("onlya", 3)
+	w.Create("delb", 4)
+	w.Create("dela", 6)
+	w.Delete("dela")
+	w.Create("gone", 5)
+	w.Delete("gone")
+	assert.Nil(t, w.Close())
+
+	w = NewWriter(&b)
+	w.Create("same", 1)
+	w.Create("changed", 7)
+	w.Create("onlyb", 8)
+	w.Create("delb", 4)
+	w.Delete("delb")
+	w.Create("dela", 9)
+	assert.Nil(t, w.Close())
+
+	d, err := Diff(bytes.NewReader(a.Bytes()), bytes.NewReader(b.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyDiff{
+		{Key: "changed", Kind: DiffChanged, A: 2, B: 7},
+		{Key: "dela", Kind: DiffDeletedA, B: 9},
+		{Key: "delb", Kind: DiffDeletedB, A: 4},
+		{Key: "onlya", Kind: DiffOnlyA, A: 3},
+		{Key: "onlyb", Kind: DiffOnlyB, B: 8},
+	}, d.Keys)
+
+	var out bytes.Buffer
+	assert.Nil(t, d.Write(&out, DiffText, "a", "b"))
+	assert.Equal(t, "changed: 2 -> 7\ndela: deleted in A (B: 9)\ndelb: deleted in B (A: 4)\nonlya: only in A (3)\nonlyb: only in B (8)\n", out.String())
+
+	out.Reset()
+	assert.Nil(t, d.Write(&out, DiffUnified, "a", "b"))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,3 +1,3 @@\n-changed 2\n-delb 4\n-onlya 3\n+changed 7\n+dela 9\n+onlyb 8\n", out.String())
+
+	out.Reset()
+	assert.Nil(t, d.Write(&out, DiffJSON, "a", "b"))
+	assert.Contains(t, out.String(), `{"key":"changed","change":"changed","a":2,"b":7},{"key":"dela","change":"deleted_a","b":9}`)
+
+	// the patch turns the state of A into the state of B
+	var patch, patched bytes.Buffer
+	w = NewWriter(&patch)
+	assert.Nil(t, d.WritePatch(w))
+	assert.Nil(t, w.Close())
+	w = NewWriter(&patched)
+	assert.Nil(t, CompactTail(w, bytes.NewReader(a.Bytes()), &patch))
+	assert.Nil(t, w.Close())
+
+	d, err = Diff(&patched, bytes.NewReader(b.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyDiff{}, d.Keys)
+	out.Reset()
+	assert.Nil(t, d.Write(&out, DiffUnified, "a", "b"))
+	assert.Equal(t, "", out.String())
+
+	_, err = Diff(bytes.NewReader(a.Bytes()), bytes.NewBufferString("1\nkey1 0\nSET key1 1\n"))
+	assert.EqualError(t, err, "B: ERROR at line 3: Key 'key1' was not created")
+}
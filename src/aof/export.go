@@ -0,0 +1,184 @@
+package aof
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ExportFormat int
+
+const (
+	ExportCSV ExportFormat = iota
+	ExportTSV
+)
+
+type ExportOrder int
+
+const (
+	OrderByKey ExportOrder = iota
+	OrderByLine
+)
+
+var exportColumns = []string{"key", "value", "deleted", "last_line", "first_line", "update_count"}
+
+// KeyState is the final state of a key after the whole body has been replayed.
+// Lines are body lines, counted from 0 as in the header; they are -1 for the keys
+// of the binary snapshot of a mixed AOF that its tail does not use.
+type KeyState struct {
+	Key         string
+	Value       int
+	Deleted     bool
+	FirstLine   int
+	LastLine    int
+	UpdateCount int // number of body lines that touched the key
+}
+
+// replay runs the parser to completion and passes every body event to fn.
+func replay(p *AOFParser, fn func(Event) error) error {
+	go p.Parse()
+	defer p.stop()
+
+	for {
+		event := p.NextEvent()
+		switch event.Type {
+		case EventError:
+			return p.Error()
+		case EventQuit, EventCompleted:
+			return nil
+		case EventHeader:
+			continue
+		}
+
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadState returns the final state of every key used in the body, ordered by the last line.
+func ReadState(rd io.Reader) ([]KeyState, error) {
+	return readStates(NewAOFParser(rd))
+}
+
+func readStates(p *AOFParser) ([]KeyState, error) {
+	return readStatesFunc(p, nil)
+}
+
+// readStatesFunc is readStates that also passes every body event to fn
+func readStatesFunc(p *AOFParser, fn func(Event)) ([]KeyState, error) {
+	index := make(map[string]int)
+	states := []KeyState{}
+
+	err := replay(p, func(event Event) error {
+		if fn != nil {
+			fn(event)
+		}
+		i, exists := index[event.Key]
+		if !exists {
+			i = len(states)
+			index[event.Key] = i
+			states = append(states, KeyState{Key: event.Key, FirstLine: event.Line})
+		}
+
+		s := &states[i]
+		s.Value = event.Value
+		s.Deleted = event.Deleted
+		s.LastLine = event.Line
+		s.UpdateCount++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the keys of a snapshot that the tail does not use come first
+	untouched := []KeyState{}
+	p.EmitUntouched(func(key string, value int) error {
+		untouched = append(untouched, KeyState{Key: key, Value: value, FirstLine: -1, LastLine: -1})
+		return nil
+	})
+	states = append(untouched, states...)
+
+	sort.Stable(byLastLine(states))
+	return states, nil
+}
+
+type byLastLine []KeyState
+
+func (s byLastLine) Len() int           { return len(s) }
+func (s byLastLine) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastLine) Less(i, j int) bool { return s[i].LastLine < s[j].LastLine }
+
+type byKey []KeyState
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+// Export writes the final key state of the AOF read from rd as RFC 4180 CSV or as TSV.
+func Export(w io.Writer, rd io.Reader, format ExportFormat, order ExportOrder) error {
+	states, err := ReadState(rd)
+	if err != nil {
+		return err
+	}
+
+	switch order {
+	case OrderByKey:
+		sort.Sort(byKey(states))
+	case OrderByLine:
+	default:
+		return fmt.Errorf("Unknown export order: %d", order)
+	}
+
+	switch format {
+	case ExportCSV:
+		return exportCSV(w, states)
+	case ExportTSV:
+		return exportTSV(w, states)
+	}
+	return fmt.Errorf("Unknown export format: %d", format)
+}
+
+func exportRecord(s KeyState) []string {
+	return []string{
+		s.Key,
+		strconv.Itoa(s.Value),
+		strconv.FormatBool(s.Deleted),
+		strconv.Itoa(s.LastLine),
+		strconv.Itoa(s.FirstLine),
+		strconv.Itoa(s.UpdateCount),
+	}
+}
+
+func exportCSV(w io.Writer, states []KeyState) error {
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, s := range states {
+		if err := cw.Write(exportRecord(s)); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportTSV(w io.Writer, states []KeyState) error {
+	if _, err := io.WriteString(w, strings.Join(exportColumns, "\t")+"\n"); err != nil {
+		return err
+	}
+	for _, s := range states {
+		if _, err := io.WriteString(w, strings.Join(exportRecord(s), "\t")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package aof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exportAOF = `4
+key,1 2
+"key2" 1
+key3 3
+key4 4
+CREATE key,1 10
+CREATE "key2" 20
+MODIFY key,1 +5
+CREATE key4 40
+DELETE key4
+`
+
+func TestReadState(t *testing.T) {
+	states, err := ReadState(strings.NewReader(exportAOF))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: `"key2"`, Value: 20, FirstLine: 1, LastLine: 1, UpdateCount: 1},
+		{Key: "key,1", Value: 15, FirstLine: 0, LastLine: 2, UpdateCount: 2},
+		{Key: "key4", Value: 40, Deleted: true, FirstLine: 3, LastLine: 4, UpdateCount: 2},
+	}, states)
+
+	_, err = ReadState(strings.NewReader("1\nkey1 0\nSET key1 1\n"))
+	assert.EqualError(t, err, "ERROR at line 3: Key 'key1' was not created")
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		format ExportFormat
+		order  ExportOrder
+		output string
+	}{
+		{
+			format: ExportCSV,
+			order:  OrderByKey,
+			output: "key,value,deleted,last_line,first_line,update_count\r\n" +
+				"\"\"\"key2\"\"\",20,false,1,1,1\r\n" +
+				"\"key,1\",15,false,2,0,2\r\n" +
+				"key4,40,true,4,3,2\r\n",
+		},
+		{
+			format: ExportTSV,
+			order:  OrderByLine,
+			output: "key\tvalue\tdeleted\tlast_line\tfirst_line\tupdate_count\n" +
+				"\"key2\"\t20\tfalse\t1\t1\t1\n" +
+				"key,1\t15\tfalse\t2\t0\t2\n" +
+				"key4\t40\ttrue\t4\t3\t2\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := Export(&buf, strings.NewReader(exportAOF), test.format, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.output, buf.String())
+	}
+}
@@ -0,0 +1,133 @@
+package aof
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errFollowReset tells the parser that the followed file was truncated or
+// replaced and is read from its start again
+var errFollowReset = errors.New("Followed file was truncated or replaced")
+
+// WithFollow keeps the parser reading at the end of the input, like tail -f,
+// instead of emitting EventCompleted. New data is polled for every poll interval.
+// A followed *os.File is read from its start again once it is truncated or
+// replaced by a new file with the same name, as log rotation does; the state
+// of the keys starts over then.
+//
+// A growing file has no final header or footer yet, so the keys are not
+// checked against one and no event is final. A header, the FOOTER marker,
+// trailers and footer indexes are skipped.
+func WithFollow(poll time.Duration) ParserOption {
+	return func(p *AOFParser) {
+		fr := &followReader{rd: p.rd, poll: poll, quit: p.quit}
+		if f, ok := p.rd.(*os.File); ok {
+			fr.f = f
+		}
+
+		p.follow = true
+		p.rd = fr
+		p.lex = newLexer(p.quit, fr)
+		p.file = fr
+	}
+}
+
+type followReader struct {
+	rd     io.Reader
+	f      *os.File
+	opened bool // f was reopened by the reader
+	pos    int64
+	poll   time.Duration
+	quit   chan struct{}
+}
+
+func (r *followReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.rd.Read(b)
+		r.pos += int64(n)
+		if n > 0 {
+			return n, nil
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if r.f != nil {
+			if err := r.check(); err != nil {
+				return 0, err
+			}
+		}
+
+		select {
+		case <-r.quit:
+			return 0, io.EOF
+		case <-time.After(r.poll):
+		}
+	}
+}
+
+// check notices a truncated or replaced file at its end
+func (r *followReader) check() error {
+	stat, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() < r.pos {
+		if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r.pos = 0
+		return errFollowReset
+	}
+
+	current, err := os.Stat(r.f.Name())
+	if err != nil || os.SameFile(stat, current) {
+		// a file moved away is followed until the new one is created
+		return nil
+	}
+
+	f, err := os.Open(r.f.Name())
+	if err != nil {
+		return nil
+	}
+	r.Close()
+	r.f, r.rd, r.opened, r.pos = f, f, true, 0
+	return errFollowReset
+}
+
+// Close closes the files the reader opened, the followed file is closed by its owner
+func (r *followReader) Close() error {
+	if r.opened {
+		return r.f.Close()
+	}
+	return nil
+}
+
+// aofFollowIdle skips the input until the followed file is truncated or replaced
+func aofFollowIdle(p *AOFParser) parserStateFunc {
+	for {
+		switch t := p.next(); t.typ {
+		case tokenError:
+			p.unexpected(t.typ)
+			return nil
+		case tokenEOF, tokenQuit:
+			return nil
+		}
+	}
+}
+
+// restart parses the followed file from its start with a new lexer
+func (p *AOFParser) restart() error {
+	p.reset = false
+	p.resetFile()
+	if err := clearStore(p.store); err != nil {
+		return err
+	}
+	p.headerSent = false
+	p.lex = newLexer(p.quit, p.rd)
+	p.lex.start()
+	p.state = aofHeaderTotal
+	return nil
+}
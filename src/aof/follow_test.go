@@ -0,0 +1,71 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendFile(t *testing.T, path string, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteString(data)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func TestParserFollow(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "follow.aof")
+
+	appendFile(t, path, "FOOTER\nCREATE key1 1\n")
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	p := NewAOFParser(f, WithFollow(time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		p.Parse()
+		close(done)
+	}()
+
+	assert.Equal(t, Event{Type: EventHeader}, p.NextEvent())
+	assert.Equal(t, Event{Type: EventCreate, Key: "key1", Value: 1, Line: 0}, p.NextEvent())
+
+	appendFile(t, path, "MODIFY key1 +2\nCREATE ke")
+	assert.Equal(t, Event{Type: EventModify, Key: "key1", Value: 3, Line: 1}, p.NextEvent())
+	time.Sleep(10 * time.Millisecond)
+	appendFile(t, path, "y2 5\n")
+	assert.Equal(t, Event{Type: EventCreate, Key: "key2", Value: 5, Line: 2}, p.NextEvent())
+
+	// the footer ends the body
+	appendFile(t, path, "INDEX 2\nkey1 1\nkey2 2\n50\nCREATE key3 3\n")
+	time.Sleep(10 * time.Millisecond)
+
+	// truncated
+	assert.Nil(t, os.Truncate(path, 0))
+	appendFile(t, path, "CREATE key1 7\n")
+	assert.Equal(t, Event{Type: EventHeader}, p.NextEvent())
+	assert.Equal(t, Event{Type: EventCreate, Key: "key1", Value: 7, Line: 0}, p.NextEvent())
+
+	// rotated
+	assert.Nil(t, os.Rename(path, path+".1"))
+	appendFile(t, path+".1", "SET key1 8\n")
+	appendFile(t, path, "1\nkey4 0\nCREATE key4 4\n")
+	assert.Equal(t, Event{Type: EventSet, Key: "key1", Value: 8, Line: 1}, p.NextEvent())
+	assert.Equal(t, Event{Type: EventHeader}, p.NextEvent())
+	assert.Equal(t, Event{Type: EventCreate, Key: "key4", Value: 4, Line: 0}, p.NextEvent())
+
+	appendFile(t, path, "SET key1 9\n")
+	event := p.NextEvent()
+	assert.Equal(t, EventError, event.Type)
+	assert.EqualError(t, p.Error(), "ERROR at line 4: Key 'key1' was not created")
+
+	p.Quit()
+	<-done
+}
@@ -0,0 +1,258 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A footer-indexed AOF starts with the FOOTER marker line instead of the header.
+// The body follows, then the optional trailer and the footer:
+//
+//	INDEX <number of keys>
+//	<key> <last line>
+//	...
+//	<byte offset of the INDEX line>
+//
+// so a writer can stream the body and append the index when it is done.
+const (
+	footerMarker = "FOOTER"
+	footerIndex  = "INDEX"
+)
+
+var (
+	ErrFooterNotSeekable = errors.New("Footer-indexed AOF requires a seekable input")
+	ErrFooterCorrupt     = errors.New("Footer index is missing or corrupt")
+	ErrNotFooterIndexed  = errors.New("AOF file is not footer-indexed")
+)
+
+// readFooter loads the index of a footer-indexed AOF before the body is streamed.
+// The reader is left at the position it had before.
+func (p *AOFParser) readFooter(rs io.ReadSeeker) error {
+	base, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// pipes look like files but cannot seek
+		return nil
+	}
+
+	marker := make([]byte, len(footerMarker)+1)
+	n, _ := io.ReadFull(rs, marker)
+	if _, err := rs.Seek(base, io.SeekStart); err != nil {
+		return err
+	}
+	if n < len(marker) || !bytes.HasPrefix(marker, []byte(footerMarker)) || !isEOL(rune(marker[len(footerMarker)])) {
+		return nil
+	}
+
+	offset, err := footerOffset(rs, base)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(base+offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, headers, err := readFooterIndex(bufio.NewReader(rs))
+	if err != nil {
+		return err
+	}
+
+	if _, err := rs.Seek(base, io.SeekStart); err != nil {
+		return err
+	}
+
+	p.indexed = true
+	p.headers = headers
+	for _, lastLine := range headers {
+		if lastLine > p.lastValidLine {
+			p.lastValidLine = lastLine
+		}
+	}
+	return nil
+}
+
+// footerOffset reads the offset of the INDEX line from the last line of the input
+func footerOffset(rs io.ReadSeeker, base int64) (int64, error) {
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	size := end - base
+	tail := int64(32)
+	if tail > size {
+		tail = size
+	}
+	if _, err := rs.Seek(end-tail, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, tail)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		return 0, err
+	}
+
+	buf = bytes.TrimRight(buf, "\r\n")
+	if i := bytes.LastIndexAny(buf, "\r\n"); i >= 0 {
+		buf = buf[i+1:]
+	}
+
+	offset, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil || offset <= int64(len(footerMarker)) || offset >= size {
+		return 0, ErrFooterCorrupt
+	}
+	return offset, nil
+}
+
+// checkFooter verifies that the input ends with a complete footer and returns its offset
+func checkFooter(rs io.ReadSeeker) (int64, error) {
+	offset, err := footerOffset(rs, 0)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	rd := bufio.NewReader(rs)
+	if _, _, err := readFooterIndex(rd); err != nil {
+		return 0, err
+	}
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return 0, ErrFooterCorrupt
+	}
+	if strconv.FormatInt(offset, 10) != strings.TrimRight(line, "\r\n") {
+		return 0, ErrFooterCorrupt
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		return 0, ErrFooterCorrupt
+	}
+	return offset, nil
+}
+
+// readFooterIndex returns the keys of the index in their order and their last lines
+func readFooterIndex(rd *bufio.Reader) ([]string, map[string]int, error) {
+	line, err := rd.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 2 || fields[0] != footerIndex {
+		return nil, nil, ErrFooterCorrupt
+	}
+
+	total, err := strconv.Atoi(fields[1])
+	if err != nil || total < 0 {
+		return nil, nil, ErrFooterCorrupt
+	}
+	return readIndexLines(rd, total, ErrFooterCorrupt)
+}
+
+// readIndexLines reads the total "key lastLine" lines of a header or a footer index
+func readIndexLines(rd *bufio.Reader, total int, corrupt error) ([]string, map[string]int, error) {
+	keys := make([]string, 0, total)
+	headers := make(map[string]int, total)
+	for i := 0; i < total; i++ {
+		line, err := rd.ReadString('\n')
+		fields := strings.Fields(line)
+		if err != nil || len(fields) != 2 {
+			return nil, nil, corrupt
+		}
+
+		lastLine, err := strconv.Atoi(fields[1])
+		if err != nil || lastLine < 0 {
+			return nil, nil, corrupt
+		}
+		keys = append(keys, fields[0])
+		headers[fields[0]] = lastLine
+	}
+	return keys, headers, nil
+}
+
+func aofFooterMarker(p *AOFParser) parserStateFunc {
+	if !p.indexed && !p.follow {
+		p.error("%v", ErrFooterNotSeekable)
+		return nil
+	}
+
+	if p.expect(tokenEOL).typ != tokenEOL {
+		return nil
+	}
+	p.curHeaderLine++
+
+	p.emitHeader()
+	if len(p.headers) == 0 && !p.follow {
+		return aofCompleted
+	}
+	return aofBodyEvent
+}
+
+// recoverFooter rebuilds the index of a footer-indexed AOF whose writer stopped before Close.
+// A partially written last line, trailer or footer is cut off. The body of a
+// checksummed AOF keeps its checksums: a line whose checksum does not match is
+// cut off too.
+func recoverFooter(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(f)
+	marker, err := rd.ReadString('\n')
+	if err != nil {
+		if strings.HasPrefix(footerMarker+"\n", marker) {
+			// the writer stopped while writing the marker
+			return f.Truncate(0)
+		}
+		return ErrNotFooterIndexed
+	} else if strings.TrimRight(marker, "\r\n") != footerMarker {
+		return ErrNotFooterIndexed
+	}
+
+	offset := int64(len(marker))
+	keys := []string{}
+	lastLines := make(map[string]int)
+	lineCount := 0
+	checksums, rolling := false, uint32(0)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == footerIndex || fields[0] == trailerRecord) {
+			break
+		}
+		text := strings.TrimRight(line, "\r\n")
+		if lineCount == 0 {
+			_, checksums = cutChecksum(text)
+		}
+		if checksums {
+			valid := false
+			if text, valid = cutChecksum(text); !valid {
+				break
+			}
+			rolling = crc32.Update(rolling, castagnoli, []byte(text+"\n"))
+		}
+		if len(fields) > 1 {
+			if _, exists := lastLines[fields[1]]; !exists {
+				keys = append(keys, fields[1])
+			}
+			lastLines[fields[1]] = lineCount
+		}
+		lineCount++
+		offset += int64(len(line))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return resumeFooterWriter(f, offset, keys, lastLines, lineCount, checksums, rolling).Close()
+}
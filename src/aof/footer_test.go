@@ -0,0 +1,129 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func footerAOF(checksums bool) string {
+	var buf bytes.Buffer
+	w := NewFooterWriter(&buf)
+	w.Checksums = checksums
+	w.Create("key1", 1)
+	w.Create("key2", 2)
+	w.Modify("key1", 10)
+	w.Delete("key2")
+	w.Close()
+	return buf.String()
+}
+
+func TestFooterWriter(t *testing.T) {
+	data := footerAOF(false)
+	assert.Equal(t, `FOOTER
+CREATE key1 1
+CREATE key2 2
+MODIFY key1 +10
+DELETE key2
+INDEX 2
+key1 2
+key2 3
+63
+`, data)
+	assert.Equal(t, "INDEX", data[63:68])
+
+	var buf bytes.Buffer
+	w := NewFooterWriter(&buf)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "FOOTER\nINDEX 0\n7\n", buf.String())
+}
+
+func TestRecoverFooter(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// a checksummed file cut anywhere is recovered with its checksums and trailer
+	data := footerAOF(true)
+	trailer := strings.Index(data, trailerRecord)
+	path := filepath.Join(dir, "cut.aof")
+	for cut := len(footerMarker) + 1; cut <= len(data); cut++ {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data[:cut]), 0644))
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		assert.Nil(t, recoverFooter(f), "cut at %d", cut)
+		f.Close()
+
+		recovered, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		if cut >= trailer {
+			assert.Equal(t, data, string(recovered), "cut at %d", cut)
+		}
+		_, err = ReadState(bytes.NewReader(recovered))
+		assert.Nil(t, err, "cut at %d", cut)
+	}
+}
+
+func TestParserFooter(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		aof := NewAOFParser(strings.NewReader(footerAOF(checksums)))
+		events := []Event{}
+		err := replay(aof, func(event Event) error {
+			events = append(events, event)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []Event{
+			{Type: EventCreate, Key: "key1", Value: 1, Line: 0},
+			{Type: EventCreate, Key: "key2", Value: 2, Line: 1},
+			{Type: EventModify | EventFinal, Key: "key1", Value: 11, Line: 2},
+			{Type: EventDelete | EventFinal, Key: "key2", Value: 2, Deleted: true, Line: 3},
+		}, events)
+	}
+
+	states, err := ReadState(strings.NewReader("FOOTER\nINDEX 0\n7\n"))
+	assert.Nil(t, err)
+	assert.Empty(t, states)
+}
+
+func TestParserFooterErrors(t *testing.T) {
+	valid := footerAOF(false)
+
+	tests := []struct {
+		rd  io.Reader
+		err string
+	}{
+		{
+			rd:  struct{ io.Reader }{strings.NewReader(valid)},
+			err: "ERROR at line 1: Footer-indexed AOF requires a seekable input",
+		},
+		{
+			rd:  strings.NewReader(strings.Replace(valid, "\n63\n", "\n62\n", 1)),
+			err: "ERROR at line 1: Footer index is missing or corrupt",
+		},
+		{
+			rd:  strings.NewReader(valid[:strings.Index(valid, "INDEX")]),
+			err: "ERROR at line 1: Footer index is missing or corrupt",
+		},
+		{
+			rd:  strings.NewReader(strings.Replace(valid, "key2 3\n", "key2 x\n", 1)),
+			err: "ERROR at line 1: Footer index is missing or corrupt",
+		},
+		{
+			rd:  strings.NewReader(strings.Replace(valid, "MODIFY key1 +10", "MODIFY key3 +10", 1)),
+			err: "ERROR at line 4: Key 'key3' was not defined in the header",
+		},
+	}
+
+	for i, test := range tests {
+		_, err := ReadState(test.rd)
+		if assert.NotNil(t, err, "test %d", i) {
+			assert.Equal(t, test.err, err.Error(), "test %d", i)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package aof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HistoryEntry is one body line of a key. Before and After are 0 while the key
+// does not exist or is deleted, so the deltas add up to the final value.
+type HistoryEntry struct {
+	Line    int // body line, counted from 0 as in the header
+	Action  EventType
+	Cycle   int // counts the CREATEs, a DELETE ends a cycle
+	Delta   int // After - Before
+	Before  int
+	After   int
+	Deleted bool
+}
+
+// keyHistory turns the states of a key into history entries
+type keyHistory struct {
+	cycle int
+	val   int
+}
+
+// newKeyHistory starts the history of key, from its value in the snapshot of a mixed AOF
+func newKeyHistory(snapshot map[string]int, key string) *keyHistory {
+	if val, exists := snapshot[key]; exists {
+		return &keyHistory{cycle: 1, val: val}
+	}
+	return &keyHistory{}
+}
+
+func (h *keyHistory) next(typ EventType, line int, v value) HistoryEntry {
+	if typ == EventCreate {
+		h.cycle++
+	}
+	after := v.val
+	if v.deleted {
+		after = 0
+	}
+	entry := HistoryEntry{Line: line, Action: typ, Cycle: h.cycle, Delta: after - h.val, Before: h.val, After: after, Deleted: v.deleted}
+	h.val = after
+	return entry
+}
+
+// History replays the AOF read from rd and passes every body line of key to fn
+func History(rd io.Reader, key string, fn func(HistoryEntry) error) error {
+	p := NewAOFParser(rd)
+	var h *keyHistory
+	return replay(p, func(event Event) error {
+		if event.Key != key {
+			return nil
+		}
+		if h == nil {
+			h = newKeyHistory(p.snapshot, key)
+		}
+		return fn(h.next(event.Type & ^EventFinal, event.Line, value{val: event.Value, deleted: event.Deleted}))
+	})
+}
+
+// FileHistory passes every body line of key in the AOF file at path to fn. The
+// offset index of the file is used when it is up to date, otherwise the file
+// is replayed.
+func FileHistory(path, key string, fn func(HistoryEntry) error) error {
+	a, err := OpenIndexed(path)
+	if err == nil {
+		err = a.History(key, fn)
+		a.Close()
+	}
+	if err != ErrIndexStale && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return History(f, key, fn)
+}
+
+// scanBody passes the byte offsets in the file and the text of the first count body lines of a parsed AOF to fn
+func scanBody(rd *bufio.Reader, count int, fn func(line int, offset int64, text string)) error {
+	skip, offset, line := 1, int64(0), 0
+	// the binary snapshot of a mixed AOF comes before the text
+	if magic, _ := rd.Peek(len(snapshotMagic)); string(magic) == snapshotMagic {
+		head := make([]byte, len(snapshotMagic)+8)
+		if _, err := io.ReadFull(rd, head); err != nil {
+			return ErrSnapshotCorrupt
+		}
+		size := int64(binary.BigEndian.Uint64(head[len(snapshotMagic):]))
+		if _, err := rd.Discard(int(size) + 4); err != nil {
+			return ErrSnapshotCorrupt
+		}
+		offset = int64(len(head)) + size + 4
+	}
+	start := offset
+	for line < count {
+		text, err := rd.ReadString('\n')
+		if err != nil && (err != io.EOF || text == "") {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if offset == start && strings.TrimSpace(text) != footerMarker {
+			total, err := strconv.Atoi(strings.TrimSpace(text))
+			if err != nil {
+				return ErrHeaderCorrupt
+			}
+			skip += total
+		}
+
+		if skip > 0 {
+			skip--
+		} else {
+			fn(line, offset, text)
+			line++
+		}
+		offset += int64(len(text))
+	}
+	return nil
+}
+
+// parseRecord parses one body line, without its checksum
+func parseRecord(line string) (dbRecord, error) {
+	fields := strings.Fields(line)
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "#") {
+		fields = fields[:n-1]
+	}
+	if len(fields) < 2 {
+		return dbRecord{}, fmt.Errorf("Invalid record: %s", strings.TrimSpace(line))
+	}
+
+	r := dbRecord{key: fields[1]}
+	args := 1
+	switch strings.ToUpper(fields[0]) {
+	case "CREATE":
+		r.typ = EventCreate
+	case "SET":
+		r.typ = EventSet
+	case "MODIFY":
+		r.typ = EventModify
+	case "DELETE":
+		r.typ, args = EventDelete, 0
+	default:
+		return dbRecord{}, fmt.Errorf("Unknown action: %s", fields[0])
+	}
+	if len(fields) != 2+args {
+		return dbRecord{}, fmt.Errorf("Invalid record: %s", strings.TrimSpace(line))
+	}
+	if args > 0 {
+		arg, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return dbRecord{}, fmt.Errorf("Invalid record: %s", strings.TrimSpace(line))
+		}
+		r.arg = int(arg)
+	}
+	return r, nil
+}
@@ -0,0 +1,143 @@
+package aof
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	data := "3\nkey1 6\nkey2 3\nkey3 4\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +4\nSET key2 7\nCREATE key3 1\nDELETE key1\nCREATE key1 3\n"
+	expected := []HistoryEntry{
+		{Line: 0, Action: EventCreate, Cycle: 1, Delta: 1, Before: 0, After: 1},
+		{Line: 2, Action: EventModify, Cycle: 1, Delta: 4, Before: 1, After: 5},
+		{Line: 5, Action: EventDelete, Cycle: 1, Delta: -5, Before: 5, After: 0, Deleted: true},
+		{Line: 6, Action: EventCreate, Cycle: 2, Delta: 3, Before: 0, After: 3},
+	}
+
+	collect := func(entries *[]HistoryEntry) func(HistoryEntry) error {
+		*entries = nil
+		return func(entry HistoryEntry) error {
+			*entries = append(*entries, entry)
+			return nil
+		}
+	}
+
+	var entries []HistoryEntry
+	assert.Nil(t, History(strings.NewReader(data), "key1", collect(&entries)))
+	assert.Equal(t, expected, entries)
+	assert.Nil(t, History(strings.NewReader(data), "key4", collect(&entries)))
+	assert.Nil(t, entries)
+
+	var footer strings.Builder
+	w := NewFooterWriter(&footer)
+	w.Checksums = true
+	w.Create("key1", 1)
+	w.Create("key2", 2)
+	w.Modify("key1", 4)
+	w.Set("key2", 7)
+	w.Create("key3", 1)
+	w.Delete("key1")
+	w.Create("key1", 3)
+	assert.Nil(t, w.Close())
+
+	opts := OffsetIndexOptions{Interval: 2, CheckpointInterval: 4}
+	for name, data := range map[string]string{"header.aof": data, "footer.aof": footer.String()} {
+		path := filepath.Join(dir, name)
+		writeFiles(t, dir, map[string]string{name: data})
+
+		// without an index the file is replayed
+		assert.False(t, OffsetIndexUpToDate(path), name)
+		assert.Nil(t, FileHistory(path, "key1", collect(&entries)), name)
+		assert.Equal(t, expected, entries, name)
+
+		assert.Nil(t, BuildOffsetIndex(path, opts), name)
+		assert.True(t, OffsetIndexUpToDate(path), name)
+		assert.Nil(t, FileHistory(path, "key1", collect(&entries)), name)
+		assert.Equal(t, expected, entries, name)
+		assert.Nil(t, FileHistory(path, "key2", collect(&entries)), name)
+		assert.Equal(t, []HistoryEntry{
+			{Line: 1, Action: EventCreate, Cycle: 1, Delta: 2, Before: 0, After: 2},
+			{Line: 3, Action: EventSet, Cycle: 1, Delta: 5, Before: 2, After: 7},
+		}, entries, name)
+		assert.Nil(t, FileHistory(path, "key4", collect(&entries)), name)
+		assert.Nil(t, entries, name)
+	}
+
+	path := filepath.Join(dir, "header.aof")
+	index, err := ioutil.ReadFile(OffsetIndexPath(path))
+	assert.Nil(t, err)
+	lines := strings.Split(string(index), "\n")
+	assert.Equal(t, []string{
+		"BLOCK 0 23 28 cac46391", "BLOCK 2 51 26 bb788716", "BLOCK 4 77 26 3c8f0933", "BLOCK 6 103 14 9cbf2cbe",
+		"CHECKPOINT 4 2", "key1 5", "key2 7",
+		"KEY key1 0 2 5 6", "KEY key2 1 3", "KEY key3 4",
+		"KEYS 1", "key1 161", "202", "",
+	}, lines[1:])
+
+	// a stale index is ignored
+	writeFiles(t, dir, map[string]string{"header.aof": strings.Replace(data, "+4", "+6", 1)})
+	assert.False(t, OffsetIndexUpToDate(path))
+	assert.Nil(t, FileHistory(path, "key1", collect(&entries)))
+	assert.Equal(t, 6, entries[1].Delta)
+
+	// the table points to every offsetKeyInterval-th key
+	var many strings.Builder
+	w = NewWriter(&many)
+	for i := 199; i >= 0; i-- {
+		w.Create(fmt.Sprintf("key%03d", i), i)
+	}
+	for i := 0; i < 200; i += 3 {
+		w.Modify(fmt.Sprintf("key%03d", i), 1)
+	}
+	assert.Nil(t, w.Close())
+	path = filepath.Join(dir, "many.aof")
+	writeFiles(t, dir, map[string]string{"many.aof": many.String()})
+	assert.Nil(t, BuildOffsetIndex(path, opts))
+	a, err := OpenIndexed(path)
+	assert.Nil(t, err)
+	defer a.Close()
+	for _, i := range []int{0, 63, 64, 65, 127, 128, 198, 199} {
+		assert.Nil(t, a.History(fmt.Sprintf("key%03d", i), collect(&entries)), "key%03d", i)
+		expected := []HistoryEntry{{Line: 199 - i, Action: EventCreate, Cycle: 1, Delta: i, Before: 0, After: i}}
+		if i%3 == 0 {
+			expected = append(expected, HistoryEntry{Line: 200 + i/3, Action: EventModify, Cycle: 1, Delta: 1, Before: i, After: i + 1})
+		}
+		assert.Equal(t, expected, entries, "key%03d", i)
+	}
+	for _, key := range []string{"a", "key0635", "key200", "z"} {
+		assert.Nil(t, a.History(key, collect(&entries)), key)
+		assert.Nil(t, entries, key)
+	}
+
+	// an index without its table is corrupt
+	index, err = ioutil.ReadFile(OffsetIndexPath(path))
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(OffsetIndexPath(path), index[:strings.Index(string(index), "KEYS")], 0644))
+	_, err = OpenIndexed(path)
+	assert.Equal(t, ErrIndexCorrupt, err)
+
+	writeFiles(t, dir, map[string]string{"bad.aof": "1\nkey1 0\nSET key1 1\n"})
+	err = BuildOffsetIndex(filepath.Join(dir, "bad.aof"), opts)
+	assert.EqualError(t, err, "ERROR at line 3: Key 'key1' was not created")
+
+	// the keys of the snapshot of a mixed AOF start from their snapshot values
+	mixed := mixedAOF("2\nk 1\nl 0\nCREATE l 2\nMODIFY k +1\n")
+	assert.Nil(t, History(strings.NewReader(mixed), "k", collect(&entries)))
+	assert.Equal(t, []HistoryEntry{{Line: 1, Action: EventModify, Cycle: 1, Delta: 1, Before: 10, After: 11}}, entries)
+	path = filepath.Join(dir, "mixed.aof")
+	writeFiles(t, dir, map[string]string{"mixed.aof": mixed})
+	assert.Nil(t, BuildOffsetIndex(path, opts))
+	assert.True(t, OffsetIndexUpToDate(path))
+	assert.Nil(t, FileHistory(path, "k", collect(&entries)))
+	assert.Equal(t, []HistoryEntry{{Line: 1, Action: EventModify, Cycle: 1, Delta: 1, Before: 10, After: 11}}, entries)
+	assert.Nil(t, FileHistory(path, "j", collect(&entries)))
+	assert.Nil(t, entries)
+}
@@ -52,6 +52,9 @@ type lexer struct {
 	tokens chan token
 	quit   chan struct{}
 	err    error
+
+	started bool
+	done    chan struct{} // closed once the lexer stops reading
 }
 
 func newLexer(quit chan struct{}, rd io.Reader) *lexer {
@@ -59,6 +62,20 @@ func newLexer(quit chan struct{}, rd io.Reader) *lexer {
 		rd:     bufio.NewReader(rd),
 		tokens: make(chan token),
 		quit:   quit,
+		done:   make(chan struct{}),
+	}
+}
+
+// start runs the lexer in a new goroutine
+func (l *lexer) start() {
+	l.started = true
+	go l.run()
+}
+
+// wait returns once a started lexer stopped reading
+func (l *lexer) wait() {
+	if l.started {
+		<-l.done
 	}
 }
 
@@ -131,6 +148,11 @@ func lexString(l *lexer) stateFunc {
 
 		space, eol := isSpace(r), isEOL(r)
 		if !space && !eol {
+			// a long value must not keep reading once the parser quits
+			if l.quitting() {
+				return nil
+			}
+
 			_, err := buf.WriteRune(r)
 			if err != nil {
 				l.error(err)
@@ -186,15 +208,29 @@ func (l *lexer) error(err error) {
 }
 
 func (l *lexer) run() {
+	defer close(l.done)
 	for l.state = lexString; l.state != nil; {
 		l.state = l.state(l)
+
+		// stop reading once the parser quits
+		if l.quitting() {
+			return
+		}
+	}
+}
+
+func (l *lexer) quitting() bool {
+	select {
+	case <-l.quit:
+		return true
+	default:
+		return false
 	}
 }
 
 func (l *lexer) nextToken() token {
 	select {
 	case <-l.quit:
-		close(l.tokens)
 		return token{typ: tokenQuit}
 	case token := <-l.tokens:
 		return token
@@ -0,0 +1,377 @@
+package aof
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A LogStore keeps the latest changes in memory and writes them to sorted
+// segment files once they reach its memory limit. A segment is a sequence of
+//
+//	uvarint key size, key, flags (1 deleted, 2 dropped), varint value
+//
+// and only every logIndexInterval-th key of a segment is kept in memory.
+// Segments are merged into one once there are too many of them.
+const (
+	logIndexInterval = 64
+	logMaxSegments   = 8
+
+	logDeleted = 1
+	logDropped = 2 // the state of the key was dropped
+)
+
+// DefaultLogStoreLimit is the memory limit of the log store of the compactor
+var DefaultLogStoreLimit int64 = 64 << 20
+
+type logEntry struct {
+	v       StoreValue
+	dropped bool
+}
+
+type logIndexEntry struct {
+	key    string
+	offset int64
+}
+
+type logSegment struct {
+	f     *os.File
+	size  int64
+	index []logIndexEntry
+}
+
+// LogStore is a log-structured store on disk for more keys than fit in memory.
+// Close removes its files.
+type LogStore struct {
+	dir      string
+	limit    int64
+	mem      map[string]logEntry
+	memSize  int64
+	segments []*logSegment // the oldest first
+	written  int
+}
+
+// NewLogStore returns a store in a new directory under dir, the default
+// temporary directory when empty, that keeps up to limit bytes of changes in memory
+func NewLogStore(dir string, limit int64) (*LogStore, error) {
+	dir, err := ioutil.TempDir(dir, "aofstore")
+	if err != nil {
+		return nil, err
+	}
+	return &LogStore{dir: dir, limit: limit, mem: make(map[string]logEntry)}, nil
+}
+
+func (s *LogStore) Close() error {
+	for _, seg := range s.segments {
+		seg.f.Close()
+	}
+	s.segments = nil
+	return os.RemoveAll(s.dir)
+}
+
+func (s *LogStore) Get(key string) (StoreValue, bool, error) {
+	if e, exists := s.mem[key]; exists {
+		return e.v, !e.dropped, nil
+	}
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		e, exists, err := s.segments[i].get(key)
+		if err != nil || exists {
+			return e.v, exists && !e.dropped, err
+		}
+	}
+	return StoreValue{}, false, nil
+}
+
+func (s *LogStore) Put(key string, v StoreValue) error {
+	return s.set(key, logEntry{v: v})
+}
+
+func (s *LogStore) Delete(key string) error {
+	return s.set(key, logEntry{dropped: true})
+}
+
+func (s *LogStore) set(key string, e logEntry) error {
+	if _, exists := s.mem[key]; !exists {
+		s.memSize += keySize(key)
+	}
+	s.mem[key] = e
+	if s.memSize < s.limit {
+		return nil
+	}
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if len(s.segments) > logMaxSegments {
+		return s.compact()
+	}
+	return nil
+}
+
+func appendLogRecord(buf []byte, key string, e logEntry) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(key)))]...)
+	buf = append(buf, key...)
+	flags := byte(0)
+	if e.v.Deleted {
+		flags |= logDeleted
+	}
+	if e.dropped {
+		flags |= logDropped
+	}
+	buf = append(buf, flags)
+	return append(buf, tmp[:binary.PutVarint(tmp, int64(e.v.Value))]...)
+}
+
+// decodeLogRecord returns the record at the start of buf and its size
+func decodeLogRecord(buf []byte) (string, logEntry, int, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || uint64(len(buf)-size) < n+1 {
+		return "", logEntry{}, 0, ErrLogStoreCorrupt
+	}
+	key := string(buf[size : size+int(n)])
+	flags := buf[size+int(n)]
+	size += int(n) + 1
+
+	val, m := binary.Varint(buf[size:])
+	if m <= 0 {
+		return "", logEntry{}, 0, ErrLogStoreCorrupt
+	}
+	e := logEntry{v: StoreValue{Value: int(val), Deleted: flags&logDeleted != 0}, dropped: flags&logDropped != 0}
+	return key, e, size + m, nil
+}
+
+var ErrLogStoreCorrupt = errors.New("Log store segment is corrupt")
+
+// writeSegment writes the entries that each passes to emit in key order to a new segment
+func (s *LogStore) writeSegment(each func(emit func(key string, e logEntry) error) error) (*logSegment, error) {
+	s.written++
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("segment-%06d", s.written)))
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &logSegment{f: f}
+	bw := bufio.NewWriter(f)
+	buf := []byte{}
+	count := 0
+	err = each(func(key string, e logEntry) error {
+		if count%logIndexInterval == 0 {
+			seg.index = append(seg.index, logIndexEntry{key: key, offset: seg.size})
+		}
+		count++
+		buf = appendLogRecord(buf[:0], key, e)
+		seg.size += int64(len(buf))
+		_, err := bw.Write(buf)
+		return err
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (s *LogStore) memKeys() []string {
+	keys := make([]string, 0, len(s.mem))
+	for key := range s.mem {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flush writes the changes in memory to a new segment
+func (s *LogStore) flush() error {
+	seg, err := s.writeSegment(func(emit func(key string, e logEntry) error) error {
+		for _, key := range s.memKeys() {
+			if err := emit(key, s.mem[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+	s.mem, s.memSize = make(map[string]logEntry), 0
+	return nil
+}
+
+// block reads the records of a segment from its i-th indexed key to the next one
+func (seg *logSegment) block(i int) ([]byte, error) {
+	end := seg.size
+	if i+1 < len(seg.index) {
+		end = seg.index[i+1].offset
+	}
+	buf := make([]byte, end-seg.index[i].offset)
+	_, err := seg.f.ReadAt(buf, seg.index[i].offset)
+	return buf, err
+}
+
+func (seg *logSegment) get(key string) (logEntry, bool, error) {
+	i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].key > key }) - 1
+	if i < 0 {
+		return logEntry{}, false, nil
+	}
+	buf, err := seg.block(i)
+	if err != nil {
+		return logEntry{}, false, err
+	}
+	for len(buf) > 0 {
+		k, e, n, err := decodeLogRecord(buf)
+		if err != nil || k > key {
+			return logEntry{}, false, err
+		} else if k == key {
+			return e, true, nil
+		}
+		buf = buf[n:]
+	}
+	return logEntry{}, false, nil
+}
+
+// logCursor reads the records of a segment, or of the memory, in key order
+type logCursor struct {
+	key   string
+	e     logEntry
+	age   int // newer sources win
+	next  func() (string, logEntry, bool, error)
+	valid bool
+}
+
+func (c *logCursor) advance() error {
+	var err error
+	c.key, c.e, c.valid, err = c.next()
+	return err
+}
+
+func (seg *logSegment) cursor() func() (string, logEntry, bool, error) {
+	i := 0
+	buf := []byte{}
+	return func() (string, logEntry, bool, error) {
+		for len(buf) == 0 {
+			if i == len(seg.index) {
+				return "", logEntry{}, false, nil
+			}
+			var err error
+			if buf, err = seg.block(i); err != nil {
+				return "", logEntry{}, false, err
+			}
+			i++
+		}
+		key, e, n, err := decodeLogRecord(buf)
+		if err != nil {
+			return "", logEntry{}, false, err
+		}
+		buf = buf[n:]
+		return key, e, true, nil
+	}
+}
+
+type logHeap []*logCursor
+
+func (h logHeap) Len() int      { return len(h) }
+func (h logHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h logHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].age > h[j].age
+}
+func (h *logHeap) Push(x interface{}) { *h = append(*h, x.(*logCursor)) }
+func (h *logHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// merge passes the newest entry of every key of the segments and the memory to fn in key order
+func (s *LogStore) merge(fn func(key string, e logEntry) error) error {
+	keys := s.memKeys()
+	i := 0
+	sources := []func() (string, logEntry, bool, error){}
+	for _, seg := range s.segments {
+		sources = append(sources, seg.cursor())
+	}
+	sources = append(sources, func() (string, logEntry, bool, error) {
+		if i == len(keys) {
+			return "", logEntry{}, false, nil
+		}
+		i++
+		return keys[i-1], s.mem[keys[i-1]], true, nil
+	})
+
+	h := &logHeap{}
+	for age, next := range sources {
+		c := &logCursor{age: age, next: next}
+		if err := c.advance(); err != nil {
+			return err
+		} else if c.valid {
+			*h = append(*h, c)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		newest := (*h)[0]
+		key, e := newest.key, newest.e
+		// older entries of the key are skipped
+		for h.Len() > 0 && (*h)[0].key == key {
+			c := (*h)[0]
+			if err := c.advance(); err != nil {
+				return err
+			} else if c.valid {
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+		if err := fn(key, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact merges all the segments into one without the dropped keys
+func (s *LogStore) compact() error {
+	seg, err := s.writeSegment(func(emit func(key string, e logEntry) error) error {
+		return s.merge(func(key string, e logEntry) error {
+			if e.dropped {
+				return nil
+			}
+			return emit(key, e)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, old := range s.segments {
+		old.f.Close()
+		os.Remove(old.f.Name())
+	}
+	s.segments = []*logSegment{seg}
+	return nil
+}
+
+// Iterate passes the keys to fn in order
+func (s *LogStore) Iterate(fn func(key string, v StoreValue) error) error {
+	return s.merge(func(key string, e logEntry) error {
+		if e.dropped {
+			return nil
+		}
+		return fn(key, e.v)
+	})
+}
@@ -0,0 +1,72 @@
+package aof
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstoretest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a segment for every 100 new keys
+	s, err := NewLogStore(dir, 100*70)
+	assert.Nil(t, err)
+
+	rnd := rand.New(rand.NewSource(4))
+	expected := make(map[string]StoreValue)
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%04d", rnd.Intn(3000))
+		if i > 15000 || rnd.Intn(3) == 0 {
+			assert.Nil(t, s.Delete(key))
+			delete(expected, key)
+		} else {
+			v := StoreValue{Value: i - 10000, Deleted: rnd.Intn(5) == 0}
+			assert.Nil(t, s.Put(key, v))
+			expected[key] = v
+		}
+		assert.True(t, len(s.segments) <= logMaxSegments)
+
+		if i%997 == 0 {
+			key := fmt.Sprintf("key%04d", rnd.Intn(3000))
+			v, exists, err := s.Get(key)
+			assert.Nil(t, err)
+			_, expectedExists := expected[key]
+			assert.Equal(t, expectedExists, exists)
+			assert.Equal(t, expected[key], v)
+		}
+	}
+	// the segments were compacted several times
+	assert.True(t, s.written > 2*logMaxSegments, "written=%d", s.written)
+
+	keys := []string{}
+	assert.Nil(t, s.Iterate(func(key string, v StoreValue) error {
+		keys = append(keys, key)
+		assert.Equal(t, expected[key], v)
+		return nil
+	}))
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, len(expected), len(keys))
+
+	for key, v := range expected {
+		got, exists, err := s.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, v, got)
+	}
+	_, exists, err := s.Get("missing")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	assert.Nil(t, s.Close())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
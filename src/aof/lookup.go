@@ -0,0 +1,114 @@
+package aof
+
+import (
+	"io"
+	"path"
+)
+
+// KeyStatus tells why a key has a value or not
+type KeyStatus int
+
+const (
+	KeyLive         KeyStatus = iota
+	KeyDeleted                // the last line of the key deleted it
+	KeyNeverCreated           // the header declares the key, the body never uses it
+	KeyNotDeclared            // the header does not declare the key
+)
+
+// lookup replays the AOF read from rd up to the last line that the header declares
+// for the keys that match, and returns the states of these keys and the header.
+// The keys of the snapshot of a mixed AOF have a state without being declared.
+func lookup(rd io.Reader, match func(string) bool) (map[string]value, map[string]int, error) {
+	p := NewAOFParser(rd)
+	// the header is read here while the body is parsed
+	p.evict = false
+	go p.Parse()
+	defer p.Quit()
+
+	values := make(map[string]value)
+	// the keys of a snapshot that the tail does not use keep their snapshot values
+	untouched := func() {
+		p.EmitUntouched(func(key string, val int) error {
+			if match(key) {
+				values[key] = value{val: val}
+			}
+			return nil
+		})
+	}
+	stop := -1
+	headerSeen := false
+	for {
+		event := p.NextEvent()
+		switch event.Type {
+		case EventError:
+			return nil, nil, p.Error()
+		case EventQuit, EventCompleted:
+			if !headerSeen {
+				untouched()
+			}
+			return values, p.headers, nil
+		case EventHeader:
+			headerSeen = true
+			untouched()
+			for key, lastLine := range p.headers {
+				if match(key) && lastLine > stop {
+					stop = lastLine
+				}
+			}
+			if stop < 0 {
+				return values, p.headers, nil
+			}
+			continue
+		}
+
+		if match(event.Key) {
+			values[event.Key] = value{val: event.Value, deleted: event.Deleted}
+		}
+		if event.Line >= stop {
+			return values, p.headers, nil
+		}
+	}
+}
+
+// Lookup returns the value of key and its status. The AOF is read only up to
+// the last line that its header declares for key.
+func Lookup(rd io.Reader, key string) (int, KeyStatus, error) {
+	values, headers, err := lookup(rd, func(k string) bool { return k == key })
+	if err != nil {
+		return 0, KeyNotDeclared, err
+	}
+
+	v, exists := values[key]
+	if _, declared := headers[key]; !declared && !exists {
+		return 0, KeyNotDeclared, nil
+	} else if !exists {
+		return 0, KeyNeverCreated, nil
+	} else if v.deleted {
+		return 0, KeyDeleted, nil
+	}
+	return v.val, KeyLive, nil
+}
+
+// LookupKeys returns the values of the live keys that match the shell pattern.
+// The AOF is read only up to the last line that its header declares for them.
+func LookupKeys(rd io.Reader, pattern string) (map[string]int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	values, _, err := lookup(rd, func(key string) bool {
+		matched, _ := path.Match(pattern, key)
+		return matched
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]int)
+	for key, v := range values {
+		if !v.deleted {
+			live[key] = v.val
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,76 @@
+package aof
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	// the body is invalid after the last line of key1
+	data := "4\nkey1 1\nkey2 2\nkey3 4\nkey4 9\nCREATE key1 1\nMODIFY key1 +2\nCREATE key2 2\nUNKNOWN\n"
+
+	tests := []struct {
+		key    string
+		value  int
+		status KeyStatus
+		err    string
+	}{
+		{"key1", 3, KeyLive, ""},
+		{"key2", 2, KeyLive, ""},
+		{"key5", 0, KeyNotDeclared, ""},
+		{"key3", 0, KeyNotDeclared, "ERROR at line 9: Unknown action: UNKNOWN"},
+	}
+
+	for _, test := range tests {
+		v, status, err := Lookup(strings.NewReader(data), test.key)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.key)
+			continue
+		}
+		assert.Nil(t, err, test.key)
+		assert.Equal(t, test.value, v, test.key)
+		assert.Equal(t, test.status, status, test.key)
+	}
+
+	data = "3\nkey1 2\nkey2 1\nkey3 3\nCREATE key1 1\nCREATE key2 2\nDELETE key1\nCREATE key3 3\n"
+	_, status, err := Lookup(strings.NewReader(data), "key1")
+	assert.Nil(t, err)
+	assert.Equal(t, KeyDeleted, status)
+
+	data = "2\nkey1 0\nkey2 0\nCREATE key1 1\n"
+	_, status, err = Lookup(strings.NewReader(data), "key2")
+	assert.Nil(t, err)
+	assert.Equal(t, KeyNeverCreated, status)
+
+	_, status, err = Lookup(strings.NewReader("0\n"), "key1")
+	assert.Nil(t, err)
+	assert.Equal(t, KeyNotDeclared, status)
+
+	data = "3\nab 1\nac 2\nb 3\nCREATE ac 1\nCREATE ab 2\nDELETE ac\nUNKNOWN\n"
+	keys, err := LookupKeys(strings.NewReader(data), "a*")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"ab": 2}, keys)
+
+	_, err = LookupKeys(strings.NewReader(data), "[")
+	assert.NotNil(t, err)
+
+	// the snapshot keys of a mixed AOF have values without being declared
+	for _, data := range []string{mixedAOF("1\nk 0\nMODIFY k +1\n"), mixedAOF("0\n")} {
+		v, status, err := Lookup(strings.NewReader(data), "j")
+		assert.Nil(t, err)
+		assert.Equal(t, KeyLive, status)
+		assert.Equal(t, 1, v)
+	}
+	v, status, err := Lookup(strings.NewReader(mixedAOF("1\nk 0\nMODIFY k +1\n")), "k")
+	assert.Nil(t, err)
+	assert.Equal(t, KeyLive, status)
+	assert.Equal(t, 11, v)
+	keys, err = LookupKeys(strings.NewReader(mixedAOF("1\nk 0\nMODIFY k +1\n")), "*")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"k": 11, "j": 1}, keys)
+	keys, err = LookupKeys(strings.NewReader(mixedAOF("1\nk 0\nDELETE k\n")), "*")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"j": 1}, keys)
+}
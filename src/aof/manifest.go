@@ -0,0 +1,405 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A manifest lists the files of a multi-part AOF, one per line:
+//
+//	seq <last sequence number used in a file name>
+//	base <name of the snapshot file>
+//	incr <name of an incremental file>
+//	...
+//
+// The files are in the directory of the manifest and are replayed as one AOF,
+// the base first, then the incremental files in their order. The base is optional.
+type Manifest struct {
+	Seq   int
+	Base  string
+	Incrs []string
+}
+
+var (
+	ErrManifestEmpty = errors.New("Manifest lists no files")
+	ErrHeaderCorrupt = errors.New("Header is missing or corrupt")
+)
+
+// ReadManifest reads the manifest at path
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	for i, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		valid := len(fields) == 2
+		if valid {
+			switch fields[0] {
+			case "seq":
+				m.Seq, err = strconv.Atoi(fields[1])
+				valid = err == nil && m.Seq >= 0
+			case "base":
+				valid = m.Base == "" && len(m.Incrs) == 0 && validFileName(fields[1])
+				m.Base = fields[1]
+			case "incr":
+				valid = validFileName(fields[1])
+				m.Incrs = append(m.Incrs, fields[1])
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid manifest line %d: %s", i+1, strings.TrimRight(line, "\r"))
+		}
+	}
+
+	if len(m.Files()) == 0 {
+		return nil, ErrManifestEmpty
+	}
+	return m, nil
+}
+
+// the files of a manifest cannot be outside of its directory
+func validFileName(name string) bool {
+	return name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// Files returns the names of the base and of the incremental files in the replay order
+func (m *Manifest) Files() []string {
+	files := []string{}
+	if m.Base != "" {
+		files = append(files, m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+func (m *Manifest) String() string {
+	lines := []string{fmt.Sprintf("seq %d", m.Seq)}
+	if m.Base != "" {
+		lines = append(lines, "base "+m.Base)
+	}
+	for _, incr := range m.Incrs {
+		lines = append(lines, "incr "+incr)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeManifest atomically replaces the manifest at path
+func writeManifest(path string, m *Manifest) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, m.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// NewManifestParser returns a parser that replays the files listed by the manifest
+// at path as one AOF. Body lines are counted across the files and an event is
+// final only in the last file that uses its key.
+func NewManifestParser(path string) (*AOFParser, error) {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, name := range m.Files() {
+		files = append(files, filepath.Join(filepath.Dir(path), name))
+	}
+	return newFilesParser(files)
+}
+
+// newFilesParser returns a parser that replays the files as one AOF
+func newFilesParser(files []string) (*AOFParser, error) {
+	lastFile := make(map[string]int)
+	for i, file := range files {
+		headers, err := readIndex(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+		for key := range headers {
+			lastFile[key] = i
+		}
+	}
+
+	p := NewAOFParser(nil)
+	p.files = files
+	p.lastFile = lastFile
+	return p, nil
+}
+
+// readIndex returns the last lines of the keys of an AOF file, from its header or
+// from its footer. An empty file has no keys.
+func readIndex(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	line, err := rd.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return map[string]int{}, nil
+	}
+
+	line = strings.TrimSpace(line)
+	if line == footerMarker {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		p := &AOFParser{}
+		if err := p.readFooter(f); err != nil {
+			return nil, err
+		}
+		return p.headers, nil
+	}
+
+	total, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, ErrHeaderCorrupt
+	} else if total <= 0 {
+		return map[string]int{}, nil
+	}
+	_, headers, err := readIndexLines(rd, total, ErrHeaderCorrupt)
+	return headers, err
+}
+
+// resetFile clears the state of the previous file before the next one is parsed
+func (p *AOFParser) resetFile() {
+	p.headerTotal = 0
+	p.headers = make(map[string]int)
+	p.curHeaderLine = 0
+	p.curBodyLine = 0
+	p.lastValidLine = 0
+	p.backup = nil
+	p.checksums = false
+	p.rolling = 0
+	p.indexed = false
+}
+
+// aofNextFile opens the next file of a manifest and starts to parse it
+func aofNextFile(p *AOFParser) parserStateFunc {
+	if p.file != nil {
+		p.file.Close()
+		p.file = nil
+	}
+
+	p.resetFile()
+
+	f, err := os.Open(p.files[p.fileIndex])
+	if err == nil {
+		p.file = f
+		var stat os.FileInfo
+		if stat, err = f.Stat(); err == nil && stat.Size() == 0 {
+			// a new incremental file may be empty after a crash
+			return aofCompleted
+		}
+	}
+	if err != nil {
+		p.err = err
+		p.emit(newEvent(EventError))
+		return nil
+	}
+
+	p.rd = f
+	p.lex = newLexer(p.quit, f)
+	if err := p.start(); err != nil {
+		p.error("%v", err)
+		return nil
+	}
+	return aofHeaderTotal
+}
+
+// WithManifest keeps the database in the files of the manifest at the path given
+// to Open instead of a single file. Updates are appended to the last incremental
+// file and a rewrite writes a new base that retires the older files.
+func WithManifest() DBOption {
+	return func(db *DB) {
+		db.multiPart = true
+	}
+}
+
+func (db *DB) fileName(seq int, kind string) string {
+	return fmt.Sprintf("%s.%d.%s.aof", filepath.Base(db.path), seq, kind)
+}
+
+func (db *DB) filePath(name string) string {
+	return filepath.Join(filepath.Dir(db.path), name)
+}
+
+// openManifest reads the manifest of the database, creating it if needed, and
+// returns the path of the file to append to
+func (db *DB) openManifest() (string, error) {
+	m, err := ReadManifest(db.path)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{}, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(m.Incrs) == 0 {
+		m.Seq++
+		m.Incrs = append(m.Incrs, db.fileName(m.Seq, "incr"))
+
+		// the manifest never lists a missing file
+		f, err := os.OpenFile(db.filePath(m.Incrs[0]), os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+		if err := writeManifest(db.path, m); err != nil {
+			return "", err
+		}
+	}
+
+	files := m.Files()
+	for _, name := range files[:len(files)-1] {
+		stat, err := os.Stat(db.filePath(name))
+		if err != nil {
+			return "", err
+		}
+		db.segSize += stat.Size()
+	}
+
+	db.manifest = m
+	return db.filePath(files[len(files)-1]), nil
+}
+
+// rollover finishes the incremental file and appends to a new one. The caller holds db.mu.
+func (db *DB) rollover() error {
+	name := db.fileName(db.manifest.Seq+1, "incr")
+	f, err := os.OpenFile(db.filePath(name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	file := db.wrap(f)
+
+	// keep the group commit off the files while they change
+	db.syncMu.Lock()
+	for db.syncing {
+		db.syncCond.Wait()
+	}
+	db.syncing = true
+	db.syncMu.Unlock()
+
+	m := &Manifest{Seq: db.manifest.Seq + 1, Base: db.manifest.Base, Incrs: append(append([]string{}, db.manifest.Incrs...), name)}
+	err = db.w.Close()
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err == nil {
+		err = writeManifest(db.path, m)
+	}
+
+	old := db.file
+	db.syncMu.Lock()
+	db.syncing = false
+	if err == nil {
+		// every update is in the finished file, which is synced
+		db.synced = db.written
+		db.segSize += db.w.offset
+		db.segLines += db.w.lineCount
+		db.f, db.file, db.w = f, file, NewFooterWriter(file)
+		db.manifest = m
+	}
+	db.syncCond.Broadcast()
+	db.syncMu.Unlock()
+
+	if err != nil {
+		// the finished file has its footer, reopen to append to it
+		db.err = ErrDBInconsistent
+		file.Close()
+		os.Remove(db.filePath(name))
+		return err
+	}
+
+	old.Close()
+	return nil
+}
+
+// rewriteBase writes the snapshot taken at the rollover to seq to a new base file
+// and retires the files it replaces
+func (db *DB) rewriteBase(snapshot map[string]int, seq int) error {
+	name := db.fileName(seq, "base")
+	f, err := os.OpenFile(db.filePath(name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	file := db.wrap(f)
+	w := NewFooterWriter(file)
+	err = writeSnapshot(w, snapshot)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err == nil && db.closed {
+		err = ErrRewriteAborted
+	}
+	incrs := db.manifest.Incrs
+	m := &Manifest{Seq: db.manifest.Seq, Base: name, Incrs: []string{db.fileName(seq, "incr")}}
+	if err == nil && incrs[len(incrs)-1] != m.Incrs[0] {
+		err = fmt.Errorf("Manifest changed during the rewrite: %s", incrs[len(incrs)-1])
+	}
+	if err == nil {
+		err = writeManifest(db.path, m)
+	}
+	if err != nil {
+		os.Remove(db.filePath(name))
+		return err
+	}
+
+	for _, old := range db.manifest.Files() {
+		if old != m.Incrs[0] {
+			os.Remove(db.filePath(old))
+		}
+	}
+
+	size, _ := db.size()
+	db.segSize, db.segLines = w.offset, w.lineCount
+	db.manifest = m
+	db.stats.BaseSize, _ = db.size()
+	db.stats.LastRewriteSaved = size - db.stats.BaseSize
+	return nil
+}
@@ -0,0 +1,175 @@
+package aof
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "manifest")
+
+	tests := []struct {
+		data     string
+		manifest *Manifest
+		err      string
+	}{
+		{"seq 3\nbase a.base\nincr a.incr\nincr b.incr\n", &Manifest{Seq: 3, Base: "a.base", Incrs: []string{"a.incr", "b.incr"}}, ""},
+		{"incr a.incr", &Manifest{Incrs: []string{"a.incr"}}, ""},
+		{"seq 1\n", nil, "Manifest lists no files"},
+		{"incr a.incr\nbase a.base\n", nil, "Invalid manifest line 2: base a.base"},
+		{"base a.base\nbase b.base\n", nil, "Invalid manifest line 2: base b.base"},
+		{"incr ../a.incr\n", nil, "Invalid manifest line 1: incr ../a.incr"},
+		{"incr a b\n", nil, "Invalid manifest line 1: incr a b"},
+		{"seq -1\nincr a\n", nil, "Invalid manifest line 1: seq -1"},
+		{"file a\n", nil, "Invalid manifest line 1: file a"},
+	}
+
+	for _, test := range tests {
+		writeFiles(t, dir, map[string]string{"manifest": test.data})
+		m, err := ReadManifest(path)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.data)
+			continue
+		}
+		assert.Nil(t, err, test.data)
+		assert.Equal(t, test.manifest, m, test.data)
+	}
+
+	m := &Manifest{Seq: 2, Base: "a.base", Incrs: []string{"a.incr"}}
+	assert.Nil(t, writeManifest(path, m))
+	read, err := ReadManifest(path)
+	assert.Nil(t, err)
+	assert.Equal(t, m, read)
+}
+
+func TestManifestParser(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var incr bytes.Buffer
+	w := NewFooterWriter(&incr)
+	w.Modify("key1", 10)
+	w.Delete("key2")
+	w.Create("key3", 3)
+	w.Close()
+
+	writeFiles(t, dir, map[string]string{
+		"manifest": "seq 3\nbase 1.base\nincr 1.incr\nincr 2.incr\nincr 3.incr\n",
+		"1.base":   "2\nkey1 0\nkey2 1\nCREATE key1 1\nCREATE key2 2\n",
+		"1.incr":   incr.String(),
+		"2.incr":   "",
+		"3.incr":   "1\nkey2 0\nCREATE key2 5\n",
+		"bad":      "incr 1.base\nincr bad.incr\n",
+		"bad.incr": "1\nkey1 0\nCREATE key1 1\n",
+		"missing":  "incr 1.base\nincr missing.incr\n",
+	})
+
+	p, err := NewManifestParser(filepath.Join(dir, "manifest"))
+	assert.Nil(t, err)
+	events := []Event{}
+	err = replay(p, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		{Type: EventCreate, Key: "key1", Value: 1, Line: 0},
+		{Type: EventCreate, Key: "key2", Value: 2, Line: 1},
+		{Type: EventModify | EventFinal, Key: "key1", Value: 11, Line: 2},
+		{Type: EventDelete, Key: "key2", Value: 2, Deleted: true, Line: 3},
+		{Type: EventCreate | EventFinal, Key: "key3", Value: 3, Line: 4},
+		{Type: EventCreate | EventFinal, Key: "key2", Value: 5, Line: 5},
+	}, events)
+
+	p, err = NewManifestParser(filepath.Join(dir, "bad"))
+	assert.Nil(t, err)
+	err = replay(p, func(Event) error { return nil })
+	assert.EqualError(t, err, "ERROR in bad.incr at line 3: Key 'key1' has already been created")
+
+	_, err = NewManifestParser(filepath.Join(dir, "missing"))
+	assert.Contains(t, err.Error(), "missing.incr: open ")
+}
+
+func TestDBManifest(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "db")
+
+	db, err := Open(path, WithManifest())
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key1", 1))
+	assert.Nil(t, db.Create("key2", 2))
+	assert.Nil(t, db.Modify("key1", 1))
+	assert.Nil(t, db.Delete("key2"))
+	assert.Nil(t, db.Close())
+
+	m, err := ReadManifest(path)
+	assert.Nil(t, err)
+	assert.Equal(t, &Manifest{Seq: 1, Incrs: []string{"db.1.incr.aof"}}, m)
+
+	db, err = Open(path, WithManifest())
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key3", 3))
+	done, err := db.BgRewrite()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Modify("key3", 1))
+	assert.Nil(t, <-done)
+
+	m, err = ReadManifest(path)
+	assert.Nil(t, err)
+	assert.Equal(t, &Manifest{Seq: 2, Base: "db.2.base.aof", Incrs: []string{"db.2.incr.aof"}}, m)
+	_, err = os.Stat(filepath.Join(dir, "db.1.incr.aof"))
+	assert.True(t, os.IsNotExist(err))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "db.2.base.aof"))
+	assert.Nil(t, err)
+	assert.Equal(t, "FOOTER\nCREATE key1 2\nCREATE key3 3\nINDEX 2\nkey1 0\nkey3 1\n35\n", string(data))
+
+	stats := db.Stats()
+	assert.Equal(t, 1, stats.Rewrites)
+	assert.Equal(t, 3, stats.Lines)
+	assert.Equal(t, 1, stats.ObsoleteLines)
+	assert.True(t, stats.LastRewriteSaved > 0)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(path, WithManifest())
+	assert.Nil(t, err)
+	v, _ := db.Get("key1")
+	assert.Equal(t, 2, v)
+	v, _ = db.Get("key3")
+	assert.Equal(t, 4, v)
+	_, exists := db.Get("key2")
+	assert.False(t, exists)
+	assert.Nil(t, db.Create("key2", 5))
+	assert.Equal(t, 4, db.Stats().Lines)
+	assert.Nil(t, db.Close())
+
+	p, err := NewManifestParser(path)
+	assert.Nil(t, err)
+	final := []Event{}
+	err = replay(p, func(event Event) error {
+		if event.Type&EventFinal == EventFinal {
+			final = append(final, event)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{
+		{Type: EventCreate | EventFinal, Key: "key1", Value: 2, Line: 0},
+		{Type: EventModify | EventFinal, Key: "key3", Value: 4, Line: 2},
+		{Type: EventCreate | EventFinal, Key: "key2", Value: 5, Line: 3},
+	}, final)
+}
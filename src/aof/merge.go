@@ -0,0 +1,131 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+)
+
+// MergePolicy tells how Merge combines a key that is used by several inputs
+type MergePolicy int
+
+const (
+	MergeLastWriter MergePolicy = iota // the state of the last input that uses the key wins
+	MergeSum                           // the MODIFY deltas of the inputs where the key is live are summed
+	MergeError                         // a key used by more than one input is an error
+)
+
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	switch s {
+	case "last":
+		return MergeLastWriter, nil
+	case "sum":
+		return MergeSum, nil
+	case "error":
+		return MergeError, nil
+	}
+	return MergeLastWriter, fmt.Errorf("Unknown merge policy: %s", s)
+}
+
+// Merge replays every input and writes the combined final state of the keys
+// to w as CREATE records; keys that end deleted are dropped. AOF records carry
+// no timestamp or sequence number, so the inputs are combined in their order:
+// with MergeLastWriter a later input wins. With MergeSum the MODIFY deltas of
+// every input are added to the value the last CREATE or SET gives the key, so
+// counters that every shard creates and MODIFYs add up; a key is deleted only
+// if it ends deleted in every input that uses it. The caller closes w.
+func Merge(w *Writer, policy MergePolicy, inputs ...io.Reader) error {
+	if policy != MergeLastWriter && policy != MergeSum && policy != MergeError {
+		return fmt.Errorf("Unknown merge policy: %d", policy)
+	}
+
+	index := make(map[string]int)
+	merged := []KeyState{}
+	owners := []int{}
+	sums := []keyDelta{}
+
+	for i, rd := range inputs {
+		states, deltas, err := readDeltas(rd)
+		if err != nil {
+			return fmt.Errorf("Input %d: %v", i+1, err)
+		}
+
+		for _, s := range states {
+			j, exists := index[s.Key]
+			if !exists {
+				j = len(merged)
+				index[s.Key] = j
+				merged = append(merged, KeyState{Key: s.Key, Deleted: true})
+				owners = append(owners, i)
+				sums = append(sums, keyDelta{})
+			}
+
+			m := &merged[j]
+			switch {
+			case policy == MergeError && exists:
+				return fmt.Errorf("Key '%s' is used by inputs %d and %d", s.Key, owners[j]+1, i+1)
+			case policy != MergeSum:
+				*m = s
+			case !s.Deleted:
+				d, touched := deltas[s.Key]
+				if !touched {
+					// a key of a snapshot that the tail does not use
+					d = keyDelta{hasBase: true, base: s.Value}
+				}
+
+				sum := &sums[j]
+				if d.hasBase {
+					sum.base, sum.hasBase = d.base, true
+				}
+				sum.delta += d.delta
+				m.Value = sum.base + sum.delta
+				m.Deleted = false
+			}
+		}
+	}
+
+	for _, s := range merged {
+		if s.Deleted {
+			continue
+		}
+		if err := w.Create(s.Key, s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyDelta is what an input does to a key: the value its last CREATE or SET
+// gives the key and the sum of the MODIFY deltas after it
+type keyDelta struct {
+	hasBase bool
+	base    int
+	delta   int
+	value   int // the value after the last event
+}
+
+// readDeltas returns the final states of the keys of an input, as ReadState
+// does, and the deltas of the keys its body uses
+func readDeltas(rd io.Reader) ([]KeyState, map[string]keyDelta, error) {
+	p := NewAOFParser(rd)
+	deltas := make(map[string]keyDelta)
+	states, err := readStatesFunc(p, func(event Event) {
+		d, seen := deltas[event.Key]
+		switch event.Type &^ EventFinal {
+		case EventCreate, EventSet:
+			d = keyDelta{hasBase: true, base: event.Value}
+		case EventModify:
+			if !seen {
+				// the key of the binary snapshot of a mixed AOF is its base
+				d.value, d.hasBase = p.snapshot[event.Key], true
+				d.base = d.value
+			}
+			d.delta += event.Value - d.value
+		case EventDelete:
+			// the MODIFYs before a DELETE do not count
+			d = keyDelta{}
+		}
+		d.value = event.Value
+		deltas[event.Key] = d
+	})
+	return states, deltas, err
+}
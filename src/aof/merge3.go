@@ -0,0 +1,266 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ModifyStrategy resolves a key that both sides only MODIFYed
+type ModifyStrategy int
+
+const (
+	ModifySum      ModifyStrategy = iota // the deltas of both sides are added, like a CRDT counter
+	ModifyConflict                       // reported as a conflict
+)
+
+// SetStrategy resolves a key that a side CREATEd or SET to a different value
+// than the other side. AOF records carry no timestamps, so the last writer is
+// the side that is applied last.
+type SetStrategy int
+
+const (
+	SetTheirs   SetStrategy = iota // theirs is applied last and wins
+	SetOurs                        // ours is applied last and wins
+	SetConflict                    // reported as a conflict
+)
+
+// DeleteStrategy resolves a key that a side deleted while the other one updated it
+type DeleteStrategy int
+
+const (
+	DeleteWins     DeleteStrategy = iota // the key is deleted
+	UpdateWins                           // the updated value is kept
+	DeleteConflict                       // reported as a conflict
+)
+
+type Merge3Options struct {
+	Modify ModifyStrategy
+	Set    SetStrategy
+	Delete DeleteStrategy
+}
+
+// Conflict is a key that Merge3 could not resolve. The states are values,
+// "deleted" or "-" for a key that does not exist.
+type Conflict struct {
+	Key    string
+	Reason string // modify, set or delete
+	Base   string
+	Ours   string
+	Theirs string
+}
+
+var ErrNotDiverged = errors.New("Ours and theirs do not both start with the body of base")
+
+// sideChanges sums up the records of one side after the common prefix
+type sideChanges struct {
+	state    value
+	exists   bool
+	absolute bool // CREATE, SET or DELETE
+	delta    int  // sum of the MODIFY deltas
+}
+
+// Merge3 merges two histories that diverged from base: ours and theirs are
+// copies of base that kept appending records. Records that both sides share
+// after base are common history too. The keys that only one side changed take
+// its state, the others are resolved with the strategies of opts. A key that
+// cannot be resolved keeps the state of ours and is returned as a conflict.
+// The merged state is written to w as CREATE records; the caller closes w.
+func Merge3(w *Writer, base, ours, theirs io.Reader, opts Merge3Options) ([]Conflict, error) {
+	inputs := [][]dbRecord{}
+	for _, input := range []struct {
+		name string
+		rd   io.Reader
+	}{{"base", base}, {"ours", ours}, {"theirs", theirs}} {
+		records, err := readRecords(input.rd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", input.name, err)
+		}
+		inputs = append(inputs, records)
+	}
+	baseRecords, ourRecords, theirRecords := inputs[0], inputs[1], inputs[2]
+
+	prefix := 0
+	for prefix < len(ourRecords) && prefix < len(theirRecords) && ourRecords[prefix] == theirRecords[prefix] {
+		prefix++
+	}
+	if len(baseRecords) > prefix {
+		return nil, ErrNotDiverged
+	}
+	for i, r := range baseRecords {
+		if ourRecords[i] != r {
+			return nil, ErrNotDiverged
+		}
+	}
+
+	keys := []string{}
+	seen := make(map[string]bool)
+	ancestor := make(map[string]value)
+	for _, r := range ourRecords[:prefix] {
+		v, exists := ancestor[r.key]
+		if !exists {
+			keys = append(keys, r.key)
+			seen[r.key] = true
+		}
+		var err error
+		if ancestor[r.key], err = applyEvent(r.typ, r.key, r.arg, v, exists); err != nil {
+			return nil, fmt.Errorf("ours: %v", err)
+		}
+	}
+
+	ourChanges, keys, err := diverged(ancestor, ourRecords[prefix:], keys, seen)
+	if err != nil {
+		return nil, fmt.Errorf("ours: %v", err)
+	}
+	theirChanges, keys, err := diverged(ancestor, theirRecords[prefix:], keys, seen)
+	if err != nil {
+		return nil, fmt.Errorf("theirs: %v", err)
+	}
+
+	conflicts := []Conflict{}
+	for _, key := range keys {
+		a, inAncestor := ancestor[key]
+		o, inOurs := ourChanges[key]
+		if !inOurs {
+			o = &sideChanges{state: a, exists: inAncestor}
+		}
+		t, inTheirs := theirChanges[key]
+		if !inTheirs {
+			t = &sideChanges{state: a, exists: inAncestor}
+		}
+
+		state, reason := a, ""
+		exists := inAncestor
+		switch {
+		case !inTheirs:
+			state, exists = o.state, o.exists
+		case !inOurs:
+			state, exists = t.state, t.exists
+		case o.state.deleted && t.state.deleted:
+			// the values a key had when both sides deleted it do not matter
+			state, exists = o.state, o.exists
+		case o.exists == t.exists && o.state == t.state:
+			state, exists = o.state, o.exists
+		case o.state.deleted != t.state.deleted:
+			live := o
+			if o.state.deleted {
+				live = t
+			}
+			switch opts.Delete {
+			case DeleteWins:
+				state.deleted = true
+			case UpdateWins:
+				state, exists = live.state, true
+			default:
+				reason = "delete"
+			}
+		case !o.absolute && !t.absolute:
+			if opts.Modify == ModifySum {
+				state.val = a.val + o.delta + t.delta
+			} else {
+				reason = "modify"
+			}
+		default:
+			switch opts.Set {
+			case SetTheirs:
+				state, exists = t.state, t.exists
+			case SetOurs:
+				state, exists = o.state, o.exists
+			default:
+				reason = "set"
+			}
+		}
+
+		if reason != "" {
+			conflicts = append(conflicts, Conflict{
+				Key:    key,
+				Reason: reason,
+				Base:   formatState(a, inAncestor),
+				Ours:   formatState(o.state, o.exists),
+				Theirs: formatState(t.state, t.exists),
+			})
+			state, exists = o.state, o.exists
+		}
+
+		if exists && !state.deleted {
+			if err := w.Create(key, state.val); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// diverged applies the records of a side after the common prefix to the ancestor state.
+// Keys used for the first time are appended to keys.
+func diverged(ancestor map[string]value, records []dbRecord, keys []string, seen map[string]bool) (map[string]*sideChanges, []string, error) {
+	changes := make(map[string]*sideChanges)
+	for _, r := range records {
+		c, exists := changes[r.key]
+		if !exists {
+			a, inAncestor := ancestor[r.key]
+			c = &sideChanges{state: a, exists: inAncestor}
+			changes[r.key] = c
+			if !seen[r.key] {
+				keys = append(keys, r.key)
+				seen[r.key] = true
+			}
+		}
+
+		var err error
+		if c.state, err = applyEvent(r.typ, r.key, r.arg, c.state, c.exists); err != nil {
+			return nil, nil, err
+		}
+		c.exists = true
+		if r.typ == EventModify {
+			c.delta += r.arg
+		} else {
+			c.absolute = true
+		}
+	}
+	return changes, keys, nil
+}
+
+func formatState(v value, exists bool) string {
+	if !exists {
+		return "-"
+	} else if v.deleted {
+		return "deleted"
+	}
+	return strconv.Itoa(v.val)
+}
+
+// readRecords replays the AOF read from rd and returns its body records. The
+// binary snapshot of a mixed AOF comes first, as CREATE records of its keys.
+func readRecords(rd io.Reader) ([]dbRecord, error) {
+	records := []dbRecord{}
+	values := make(map[string]int)
+	p := NewAOFParser(rd)
+	err := replay(p, func(event Event) error {
+		typ := event.Type & ^EventFinal
+		arg := event.Value
+		if typ == EventModify {
+			base, exists := values[event.Key]
+			if !exists {
+				base = p.snapshot[event.Key]
+			}
+			arg = event.Value - base
+		} else if typ == EventDelete {
+			arg = 0
+		}
+		values[event.Key] = event.Value
+
+		records = append(records, dbRecord{typ: typ, key: event.Key, arg: arg})
+		return nil
+	})
+	if err != nil || len(p.snapshotKeys) == 0 {
+		return records, err
+	}
+
+	snapshot := make([]dbRecord, 0, len(p.snapshotKeys)+len(records))
+	for _, key := range p.snapshotKeys {
+		snapshot = append(snapshot, dbRecord{typ: EventCreate, key: key, arg: p.snapshot[key]})
+	}
+	return append(snapshot, records...), nil
+}
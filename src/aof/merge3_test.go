@@ -0,0 +1,82 @@
+package aof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "4\nkey1 0\nkey2 1\nkey3 2\nkey4 3\nCREATE key1 10\nCREATE key2 20\nCREATE key3 30\nCREATE key4 40\n"
+	ours := "6\nkey1 5\nkey2 6\nkey3 7\nkey4 3\nkey5 9\nkey6 8\nCREATE key1 10\nCREATE key2 20\nCREATE key3 30\nCREATE key4 40\n" +
+		"MODIFY key1 +1\nMODIFY key1 +2\nSET key2 21\nDELETE key3\nCREATE key6 6\nCREATE key5 50\n"
+	theirs := "5\nkey1 5\nkey2 6\nkey3 7\nkey4 8\nkey5 9\nCREATE key1 10\nCREATE key2 20\nCREATE key3 30\nCREATE key4 40\n" +
+		"MODIFY key1 +1\nMODIFY key1 +5\nSET key2 22\nMODIFY key3 +3\nDELETE key4\nCREATE key5 51\n"
+
+	tests := []struct {
+		opts      Merge3Options
+		output    string
+		conflicts []Conflict
+	}{
+		{
+			opts:   Merge3Options{},
+			output: "4\nkey1 0\nkey2 1\nkey6 2\nkey5 3\nCREATE key1 18\nCREATE key2 22\nCREATE key6 6\nCREATE key5 51\n",
+		},
+		{
+			opts:   Merge3Options{Set: SetOurs, Delete: UpdateWins},
+			output: "5\nkey1 0\nkey2 1\nkey3 2\nkey6 3\nkey5 4\nCREATE key1 18\nCREATE key2 21\nCREATE key3 33\nCREATE key6 6\nCREATE key5 50\n",
+		},
+		{
+			opts:   Merge3Options{Modify: ModifyConflict, Set: SetConflict, Delete: DeleteConflict},
+			output: "4\nkey1 0\nkey2 1\nkey6 2\nkey5 3\nCREATE key1 13\nCREATE key2 21\nCREATE key6 6\nCREATE key5 50\n",
+			conflicts: []Conflict{
+				{Key: "key1", Reason: "modify", Base: "11", Ours: "13", Theirs: "16"},
+				{Key: "key2", Reason: "set", Base: "20", Ours: "21", Theirs: "22"},
+				{Key: "key3", Reason: "delete", Base: "30", Ours: "deleted", Theirs: "33"},
+				{Key: "key5", Reason: "set", Base: "-", Ours: "50", Theirs: "51"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		conflicts, err := Merge3(w, strings.NewReader(base), strings.NewReader(ours), strings.NewReader(theirs), test.opts)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String())
+		if test.conflicts == nil {
+			test.conflicts = []Conflict{}
+		}
+		assert.Equal(t, test.conflicts, conflicts)
+	}
+
+	_, err := Merge3(NewWriter(&bytes.Buffer{}), strings.NewReader(base), strings.NewReader("1\nkey1 0\nCREATE key1 10\n"), strings.NewReader(theirs), Merge3Options{})
+	assert.Equal(t, ErrNotDiverged, err)
+
+	_, err = Merge3(NewWriter(&bytes.Buffer{}), strings.NewReader(base), strings.NewReader("1\nkey1 0\nSET key1 10\n"), strings.NewReader(theirs), Merge3Options{})
+	assert.EqualError(t, err, "ours: ERROR at line 3: Key 'key1' was not created")
+
+	// the snapshot of mixed AOFs is the common history
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	conflicts, err := Merge3(w, strings.NewReader(mixedAOF("0\n")), strings.NewReader(mixedAOF("1\nk 0\nMODIFY k +1\n")), strings.NewReader(mixedAOF("1\nk 0\nMODIFY k +2\n")), Merge3Options{})
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "2\nk 0\nj 1\nCREATE k 13\nCREATE j 1\n", buf.String())
+
+	// a key that both sides deleted is deleted, whatever its values were
+	buf.Reset()
+	w = NewWriter(&buf)
+	body := "CREATE k 10\nCREATE j 1\n"
+	ours = "2\nk 3\nj 1\n" + body + "MODIFY k +1\nDELETE k\n"
+	theirs = "2\nk 2\nj 1\n" + body + "DELETE k\n"
+	conflicts, err = Merge3(w, strings.NewReader("2\nk 0\nj 1\n"+body), strings.NewReader(ours), strings.NewReader(theirs), Merge3Options{Modify: ModifyConflict, Set: SetConflict, Delete: DeleteConflict})
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "1\nj 0\nCREATE j 1\n", buf.String())
+}
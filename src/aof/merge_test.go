@@ -0,0 +1,101 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	inputs := []string{
+		"3\nkey1 2\nkey2 1\nkey3 3\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +4\nCREATE key3 3\n",
+		"2\nkey1 1\nkey2 2\nCREATE key1 10\nMODIFY key1 +1\nCREATE key2 1\n",
+		"2\nkey3 1\nkey4 2\nCREATE key3 0\nDELETE key3\nCREATE key4 4\n",
+	}
+
+	tests := []struct {
+		policy MergePolicy
+		output string
+		err    string
+	}{
+		{MergeLastWriter, "3\nkey2 0\nkey1 1\nkey4 2\nCREATE key2 1\nCREATE key1 11\nCREATE key4 4\n", ""},
+		{MergeSum, "4\nkey2 0\nkey1 1\nkey3 2\nkey4 3\nCREATE key2 1\nCREATE key1 15\nCREATE key3 3\nCREATE key4 4\n", ""},
+		{MergeError, "", "Key 'key1' is used by inputs 1 and 2"},
+		{MergePolicy(7), "", "Unknown merge policy: 7"},
+	}
+
+	for _, test := range tests {
+		readers := []io.Reader{}
+		for _, input := range inputs {
+			readers = append(readers, strings.NewReader(input))
+		}
+
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		err := Merge(w, test.policy, readers...)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String())
+	}
+
+	err := Merge(NewWriter(&bytes.Buffer{}), MergeLastWriter, strings.NewReader("1\nkey1 0\nSET key1 1\n"))
+	assert.EqualError(t, err, "Input 1: ERROR at line 3: Key 'key1' was not created")
+
+	for _, name := range []string{"last", "sum", "error"} {
+		_, err := ParseMergePolicy(name)
+		assert.Nil(t, err)
+	}
+	_, err = ParseMergePolicy("first")
+	assert.EqualError(t, err, "Unknown merge policy: first")
+}
+
+func TestMergeSum(t *testing.T) {
+	var mixed bytes.Buffer
+	WriteBinarySnapshot(&mixed, []string{"c", "d"}, map[string]int{"c": 100, "d": 7})
+	mixed.WriteString("1\nc 0\nMODIFY c +2\n")
+
+	tests := []struct {
+		inputs []string
+		output string
+	}{
+		{
+			// every shard creates the counter and MODIFYs it
+			[]string{"1\nc 1\nCREATE c 100\nMODIFY c +5\n", "1\nc 1\nCREATE c 100\nMODIFY c +3\n"},
+			"1\nc 0\nCREATE c 108\n",
+		},
+		{
+			// the MODIFYs before a SET do not count, the last input gives the base
+			[]string{"1\nc 2\nCREATE c 1\nMODIFY c +5\nSET c 10\n", "1\nc 2\nCREATE c 100\nMODIFY c -3\nMODIFY c +1\n"},
+			"1\nc 0\nCREATE c 98\n",
+		},
+		{
+			// a shard that deleted the key adds nothing
+			[]string{"1\nc 1\nCREATE c 100\nMODIFY c +5\n", "1\nc 2\nCREATE c 100\nMODIFY c +3\nDELETE c\n"},
+			"1\nc 0\nCREATE c 105\n",
+		},
+		{
+			[]string{mixed.String(), "1\nc 1\nCREATE c 100\nMODIFY c +3\n"},
+			"2\nd 0\nc 1\nCREATE d 7\nCREATE c 105\n",
+		},
+	}
+
+	for i, test := range tests {
+		readers := []io.Reader{}
+		for _, input := range test.inputs {
+			readers = append(readers, strings.NewReader(input))
+		}
+
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		assert.Nil(t, Merge(w, MergeSum, readers...), "test %d", i)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String(), "test %d", i)
+	}
+}
@@ -0,0 +1,576 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An offset index is a sidecar file next to an AOF file, named like it with
+// the .offsets extension. The body is cut in blocks of Interval lines, the
+// index holds the byte offset, the size and the checksum of every block,
+// checkpoints of the live keys before every CheckpointInterval-th body line
+// and the body lines of every key, sorted by key. It ends with a table of
+// every offsetKeyInterval-th key and the offset of its KEY line, so a key is
+// looked up without reading all of them:
+//
+//	AOFOFFSETS <size> <modification time in nanoseconds> <body lines> <interval>
+//	BLOCK <line> <offset> <size> <CRC32C of the block>
+//	CHECKPOINT <line> <number of keys>
+//	<key> <value>
+//	KEY <key> <line> ...
+//	KEYS <number of keys in the table>
+//	<key> <offset of its KEY line>
+//	<offset of the KEYS line>
+//
+// An index is used only while the size and the modification time of the AOF
+// file match the ones it was built for. The blocks that are read are checked
+// against their checksums. The snapshot of a mixed AOF is the checkpoint of
+// line 0 and the offsets of the blocks count from the start of the file.
+const (
+	offsetIndexExt    = ".offsets"
+	offsetIndexMarker = "AOFOFFSETS"
+	offsetKeyTable    = "KEYS"
+	offsetKeyInterval = 64
+)
+
+// OffsetIndexOptions tells how dense an offset index is, in body lines
+type OffsetIndexOptions struct {
+	Interval           int // lines between two offsets
+	CheckpointInterval int // lines between two checkpoints, a multiple of Interval
+}
+
+var DefaultOffsetIndexOptions = OffsetIndexOptions{Interval: 1024, CheckpointInterval: 65536}
+
+var (
+	ErrInvalidIndexOptions = errors.New("Index intervals must be positive and the checkpoint interval a multiple of the interval")
+	ErrIndexStale          = errors.New("Offset index is out of date")
+	ErrIndexCorrupt        = errors.New("Offset index is corrupt")
+)
+
+// OffsetIndexPath returns the path of the offset index of the AOF file at path
+func OffsetIndexPath(path string) string {
+	return path + offsetIndexExt
+}
+
+type checkpoint struct {
+	line   int // the state is the one before this line
+	values map[string]int
+}
+
+type block struct {
+	offset int64
+	size   int
+	sum    uint32
+}
+
+func indexStamp(stat os.FileInfo) string {
+	return fmt.Sprintf("%d %d", stat.Size(), stat.ModTime().UnixNano())
+}
+
+// BuildOffsetIndex replays the AOF file at path and writes its offset index
+func BuildOffsetIndex(path string, opts OffsetIndexOptions) error {
+	if opts.Interval <= 0 || opts.CheckpointInterval <= 0 || opts.CheckpointInterval%opts.Interval != 0 {
+		return ErrInvalidIndexOptions
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	lines := make(map[string][]int)
+	live := make(map[string]int)
+	checkpoints := []checkpoint{}
+	lineCount := 0
+	p := NewAOFParser(f)
+	err = replay(p, func(event Event) error {
+		// the keys of the snapshot of a mixed AOF are live before the first line
+		if event.Line == 0 {
+			for key, val := range p.snapshot {
+				live[key] = val
+			}
+		}
+		lines[event.Key] = append(lines[event.Key], event.Line)
+		if event.Deleted {
+			delete(live, event.Key)
+		} else {
+			live[event.Key] = event.Value
+		}
+
+		lineCount = event.Line + 1
+		if lineCount%opts.CheckpointInterval == 0 {
+			values := make(map[string]int, len(live))
+			for key, val := range live {
+				values[key] = val
+			}
+			checkpoints = append(checkpoints, checkpoint{line: lineCount, values: values})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(p.snapshot) > 0 {
+		checkpoints = append([]checkpoint{{line: 0, values: p.snapshot}}, checkpoints...)
+	}
+
+	// blocks come from a second pass, on a handle of its own as the lexer may still read
+	rd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	blocks := []block{}
+	err = scanBody(bufio.NewReader(rd), lineCount, func(line int, offset int64, text string) {
+		if line%opts.Interval == 0 {
+			blocks = append(blocks, block{offset: offset})
+		}
+		b := &blocks[len(blocks)-1]
+		b.size += len(text)
+		b.sum = crc32.Update(b.sum, castagnoli, []byte(text))
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(lines))
+	for key := range lines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmpPath := OffsetIndexPath(path) + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(out)
+	offset := 0
+	write := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(bw, format, args...)
+		offset += n
+	}
+
+	write("%s %s %d %d\n", offsetIndexMarker, indexStamp(stat), lineCount, opts.Interval)
+	for i, b := range blocks {
+		write("BLOCK %d %d %d %08x\n", i*opts.Interval, b.offset, b.size, b.sum)
+	}
+	for _, cp := range checkpoints {
+		write("CHECKPOINT %d %d\n", cp.line, len(cp.values))
+		for _, key := range sortedKeys(cp.values) {
+			write("%s %d\n", key, cp.values[key])
+		}
+	}
+	table := []string{}
+	for i, key := range keys {
+		if i%offsetKeyInterval == 0 {
+			table = append(table, fmt.Sprintf("%s %d\n", key, offset))
+		}
+		write("KEY %s", key)
+		for _, line := range lines[key] {
+			write(" %d", line)
+		}
+		write("\n")
+	}
+	tableOffset := offset
+	write("%s %d\n", offsetKeyTable, len(table))
+	for _, entry := range table {
+		write("%s", entry)
+	}
+	write("%d\n", tableOffset)
+	err = bw.Flush()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	// a file that changed meanwhile would get an index of its old content
+	if err == nil {
+		var now os.FileInfo
+		if now, err = os.Stat(path); err == nil && indexStamp(now) != indexStamp(stat) {
+			err = fmt.Errorf("File changed while it was indexed: %s", path)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, OffsetIndexPath(path))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+type keyTableEntry struct {
+	key    string
+	offset int64
+}
+
+// IndexedAOF is an AOF file opened with its offset index for random access
+type IndexedAOF struct {
+	Lines       int // body lines
+	f           *os.File
+	idx         *os.File
+	interval    int
+	blocks      []block
+	checkpoints []checkpoint
+	table       []keyTableEntry
+	tableOffset int64
+}
+
+// OpenIndexed opens the AOF file at path with its offset index. It returns
+// ErrIndexStale when the index does not match the file.
+func OpenIndexed(path string) (*IndexedAOF, error) {
+	idx, err := os.Open(OffsetIndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+
+	a := &IndexedAOF{f: f, idx: idx}
+	if err := a.readIndex(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// OffsetIndexUpToDate tells whether the AOF file at path has an offset index
+// that matches its size and modification time
+func OffsetIndexUpToDate(path string) bool {
+	a, err := OpenIndexed(path)
+	if err == nil {
+		a.Close()
+	}
+	return err == nil
+}
+
+// readIndex reads the key table, then the header, the blocks and the checkpoints before the keys
+func (a *IndexedAOF) readIndex() error {
+	if err := a.readKeyTable(); err != nil {
+		return err
+	}
+	end := a.tableOffset
+	if len(a.table) > 0 {
+		end = a.table[0].offset
+	}
+	rd := bufio.NewReader(io.NewSectionReader(a.idx, 0, end))
+
+	line, err := rd.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 5 || fields[0] != offsetIndexMarker {
+		return ErrIndexCorrupt
+	}
+	n, valid := parseInts(fields, 1)
+	if !valid || n[2] < 0 || n[3] <= 0 {
+		return ErrIndexCorrupt
+	}
+	a.Lines, a.interval = int(n[2]), int(n[3])
+
+	stat, err := a.f.Stat()
+	if err != nil {
+		return err
+	} else if fmt.Sprintf("%s %s", fields[1], fields[2]) != indexStamp(stat) {
+		return ErrIndexStale
+	}
+
+	var cp *checkpoint
+	remaining := 0
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil {
+			return ErrIndexCorrupt
+		}
+
+		fields := strings.Fields(line)
+		if remaining > 0 {
+			n, valid := parseInts(fields, 1)
+			if !valid || len(fields) != 2 {
+				return ErrIndexCorrupt
+			}
+			cp.values[fields[0]] = int(n[0])
+			remaining--
+			continue
+		}
+		if len(fields) == 0 {
+			return ErrIndexCorrupt
+		}
+
+		switch fields[0] {
+		case "BLOCK":
+			if len(fields) != 5 {
+				return ErrIndexCorrupt
+			}
+			n, valid := parseInts(fields[:4], 1)
+			sum, err := strconv.ParseUint(fields[4], 16, 32)
+			if !valid || err != nil || n[0] != int64(len(a.blocks)*a.interval) || n[1] < 0 || n[2] <= 0 || n[1]+n[2] > stat.Size() {
+				return ErrIndexCorrupt
+			}
+			a.blocks = append(a.blocks, block{offset: n[1], size: int(n[2]), sum: uint32(sum)})
+		case "CHECKPOINT":
+			n, valid := parseInts(fields, 1)
+			if !valid || len(n) != 2 || n[0]%int64(a.interval) != 0 || n[1] < 0 || (cp != nil && n[0] <= int64(cp.line)) {
+				return ErrIndexCorrupt
+			}
+			a.checkpoints = append(a.checkpoints, checkpoint{line: int(n[0]), values: make(map[string]int, n[1])})
+			cp = &a.checkpoints[len(a.checkpoints)-1]
+			remaining = int(n[1])
+		default:
+			return ErrIndexCorrupt
+		}
+	}
+	if remaining > 0 || len(a.blocks) != (a.Lines+a.interval-1)/a.interval {
+		return ErrIndexCorrupt
+	}
+	return nil
+}
+
+// readKeyTable reads the key table at the end of the index
+func (a *IndexedAOF) readKeyTable() error {
+	offset, err := footerOffset(a.idx, 0)
+	if err == ErrFooterCorrupt {
+		return ErrIndexCorrupt
+	} else if err != nil {
+		return err
+	}
+	if _, err := a.idx.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	a.tableOffset = offset
+
+	rd := bufio.NewReader(a.idx)
+	line, err := rd.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 2 || fields[0] != offsetKeyTable {
+		return ErrIndexCorrupt
+	}
+	total, err := strconv.Atoi(fields[1])
+	if err != nil || total < 0 {
+		return ErrIndexCorrupt
+	}
+
+	a.table = make([]keyTableEntry, 0, total)
+	for i := 0; i < total; i++ {
+		line, err := rd.ReadString('\n')
+		fields := strings.Fields(line)
+		n, valid := parseInts(fields, 1)
+		if err != nil || !valid || len(n) != 1 || n[0] >= offset || (i > 0 && n[0] <= a.table[i-1].offset) {
+			return ErrIndexCorrupt
+		}
+		a.table = append(a.table, keyTableEntry{key: fields[0], offset: n[0]})
+	}
+	return nil
+}
+
+// parseInts parses the fields from the first one on as numbers
+func parseInts(fields []string, first int) ([]int64, bool) {
+	if len(fields) <= first {
+		return nil, false
+	}
+	n := make([]int64, 0, len(fields)-first)
+	for _, field := range fields[first:] {
+		i, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		n = append(n, i)
+	}
+	return n, true
+}
+
+func (a *IndexedAOF) Close() error {
+	a.idx.Close()
+	return a.f.Close()
+}
+
+// keyLines returns the body lines of a key, nil when the key is not used.
+// Only the keys from the table entry at or before key to the next one are read.
+func (a *IndexedAOF) keyLines(key string) ([]int, error) {
+	i := sort.Search(len(a.table), func(i int) bool { return a.table[i].key > key }) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	end := a.tableOffset
+	if i+1 < len(a.table) {
+		end = a.table[i+1].offset
+	}
+	buf := make([]byte, end-a.table[i].offset)
+	if _, err := a.idx.ReadAt(buf, a.table[i].offset); err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "KEY" || fields[1] != key {
+			continue
+		}
+		n, valid := parseInts(fields, 2)
+		if !valid {
+			return nil, ErrIndexCorrupt
+		}
+		lines := make([]int, len(n))
+		for j := range n {
+			if n[j] < 0 || n[j] >= int64(a.Lines) || (j > 0 && n[j] <= n[j-1]) {
+				return nil, ErrIndexCorrupt
+			}
+			lines[j] = int(n[j])
+		}
+		return lines, nil
+	}
+	return nil, nil
+}
+
+// KeyLines returns the first and the last body line of a key and whether the key is used
+func (a *IndexedAOF) KeyLines(key string) (int, int, bool, error) {
+	lines, err := a.keyLines(key)
+	if err != nil || lines == nil {
+		return 0, 0, false, err
+	}
+	return lines[0], lines[len(lines)-1], true, nil
+}
+
+// readBlock returns the lines of the i-th block, without their ends of line.
+// It returns ErrIndexStale when the block does not match its checksum.
+func (a *IndexedAOF) readBlock(i int) ([]string, error) {
+	b := a.blocks[i]
+	buf := make([]byte, b.size)
+	if _, err := a.f.ReadAt(buf, b.offset); err != nil && err != io.EOF {
+		return nil, err
+	} else if crc32.Checksum(buf, castagnoli) != b.sum {
+		return nil, ErrIndexStale
+	}
+
+	lines := strings.SplitAfter(string(buf), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	count := a.interval
+	if rest := a.Lines - i*a.interval; rest < count {
+		count = rest
+	}
+	if len(lines) != count {
+		return nil, ErrIndexCorrupt
+	}
+	for j := range lines {
+		lines[j] = strings.TrimRight(lines[j], "\r\n")
+	}
+	return lines, nil
+}
+
+// ReadLine returns the text of a body line, without its end of line
+func (a *IndexedAOF) ReadLine(line int) (string, error) {
+	if line < 0 || line >= a.Lines {
+		return "", fmt.Errorf("Line %d is out of range", line)
+	}
+	lines, err := a.readBlock(line / a.interval)
+	if err != nil {
+		return "", err
+	}
+	return lines[line%a.interval], nil
+}
+
+// StateAt returns the values of the live keys once the body line has been
+// applied. The body is replayed from the nearest checkpoint before it.
+func (a *IndexedAOF) StateAt(line int) (map[string]int, error) {
+	if line < 0 || line >= a.Lines {
+		return nil, fmt.Errorf("Line %d is out of range", line)
+	}
+	cp := checkpoint{values: map[string]int{}}
+	i := sort.Search(len(a.checkpoints), func(i int) bool { return a.checkpoints[i].line > line })
+	if i > 0 {
+		cp = a.checkpoints[i-1]
+	}
+
+	values := make(map[string]int, len(cp.values))
+	for key, val := range cp.values {
+		values[key] = val
+	}
+	for b := cp.line / a.interval; b <= line/a.interval; b++ {
+		lines, err := a.readBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		for j, text := range lines {
+			if b*a.interval+j > line {
+				break
+			}
+			r, err := parseRecord(text)
+			if err != nil {
+				return nil, err
+			}
+
+			val, exists := values[r.key]
+			v, err := applyEvent(r.typ, r.key, r.arg, value{val: val}, exists)
+			if err != nil {
+				return nil, err
+			}
+			if v.deleted {
+				delete(values, r.key)
+			} else {
+				values[r.key] = v.val
+			}
+		}
+	}
+	return values, nil
+}
+
+// History passes every body line of key to fn. The lines are read and checked
+// before the first call, so a stale index returns ErrIndexStale before fn is called.
+func (a *IndexedAOF) History(key string, fn func(HistoryEntry) error) error {
+	lines, err := a.keyLines(key)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]HistoryEntry, 0, len(lines))
+	snapshot := map[string]int{}
+	if len(a.checkpoints) > 0 && a.checkpoints[0].line == 0 {
+		snapshot = a.checkpoints[0].values
+	}
+	h := newKeyHistory(snapshot, key)
+	val, exists := snapshot[key]
+	v := value{val: val}
+	current, text := -1, []string{}
+	for _, line := range lines {
+		if line/a.interval != current {
+			current = line / a.interval
+			if text, err = a.readBlock(current); err != nil {
+				return err
+			}
+		}
+		r, err := parseRecord(text[line%a.interval])
+		if err != nil || r.key != key {
+			return ErrIndexCorrupt
+		}
+
+		if v, err = applyEvent(r.typ, key, r.arg, v, exists); err != nil {
+			return ErrIndexCorrupt
+		}
+		exists = true
+		entries = append(entries, h.next(r.typ, line, v))
+	}
+
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
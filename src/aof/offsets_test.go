@@ -0,0 +1,139 @@
+package aof
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetIndex(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var header, footer bytes.Buffer
+	for _, w := range []*Writer{NewWriter(&header), NewFooterWriter(&footer)} {
+		w.Checksums = w.footer
+		w.Create("key1", 1)
+		w.Create("key2", 2)
+		w.Modify("key1", 3)
+		w.Delete("key2")
+		w.Create("key3", 3)
+		w.Create("key2", 5)
+		w.Set("key1", 7)
+		w.Delete("key3")
+		w.Modify("key2", -1)
+		assert.Nil(t, w.Close())
+	}
+
+	states := []map[string]int{
+		{"key1": 1},
+		{"key1": 1, "key2": 2},
+		{"key1": 4, "key2": 2},
+		{"key1": 4},
+		{"key1": 4, "key3": 3},
+		{"key1": 4, "key2": 5, "key3": 3},
+		{"key1": 7, "key2": 5, "key3": 3},
+		{"key1": 7, "key2": 5},
+		{"key1": 7, "key2": 4},
+	}
+
+	assert.Equal(t, ErrInvalidIndexOptions, BuildOffsetIndex(filepath.Join(dir, "header.aof"), OffsetIndexOptions{Interval: 2, CheckpointInterval: 3}))
+
+	for name, data := range map[string]string{"header.aof": header.String(), "footer.aof": footer.String()} {
+		path := filepath.Join(dir, name)
+		writeFiles(t, dir, map[string]string{name: data})
+		_, err := OpenIndexed(path)
+		assert.True(t, os.IsNotExist(err), name)
+
+		assert.Nil(t, BuildOffsetIndex(path, OffsetIndexOptions{Interval: 2, CheckpointInterval: 4}), name)
+		a, err := OpenIndexed(path)
+		assert.Nil(t, err, name)
+		assert.Equal(t, 9, a.Lines, name)
+
+		body := strings.Split(data, "\n")
+		if name == "header.aof" {
+			body = body[4:]
+		} else {
+			body = body[1:]
+		}
+		for line := 0; line < a.Lines; line++ {
+			text, err := a.ReadLine(line)
+			assert.Nil(t, err, name)
+			assert.Equal(t, body[line], text, name)
+
+			state, err := a.StateAt(line)
+			assert.Nil(t, err, name)
+			assert.Equal(t, states[line], state, "%s line %d", name, line)
+		}
+		_, err = a.ReadLine(9)
+		assert.EqualError(t, err, "Line 9 is out of range", name)
+
+		first, last, exists, err := a.KeyLines("key2")
+		assert.Nil(t, err, name)
+		assert.True(t, exists, name)
+		assert.Equal(t, []int{1, 8}, []int{first, last}, name)
+		_, _, exists, err = a.KeyLines("key4")
+		assert.Nil(t, err, name)
+		assert.False(t, exists, name)
+		assert.Nil(t, a.Close(), name)
+	}
+
+	// same size, different content
+	path := filepath.Join(dir, "header.aof")
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	writeFiles(t, dir, map[string]string{"header.aof": strings.Replace(header.String(), "SET key1 7", "SET key1 8", 1)})
+	_, err = OpenIndexed(path)
+	assert.Equal(t, ErrIndexStale, err)
+
+	// with the same modification time only the changed block is stale
+	assert.Nil(t, os.Chtimes(path, stat.ModTime(), stat.ModTime()))
+	a, err := OpenIndexed(path)
+	assert.Nil(t, err)
+	text, err := a.ReadLine(5)
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE key2 5", text)
+	_, err = a.ReadLine(6)
+	assert.Equal(t, ErrIndexStale, err)
+	state, err := a.StateAt(5)
+	assert.Nil(t, err)
+	assert.Equal(t, states[5], state)
+	_, err = a.StateAt(7)
+	assert.Equal(t, ErrIndexStale, err)
+	assert.Equal(t, ErrIndexStale, a.History("key1", func(HistoryEntry) error { return nil }))
+	assert.Nil(t, a.Close())
+
+	// the history falls back to the file
+	var values []int
+	assert.Nil(t, FileHistory(path, "key1", func(entry HistoryEntry) error {
+		values = append(values, entry.After)
+		return nil
+	}))
+	assert.Equal(t, []int{1, 4, 8}, values)
+
+	appendFile(t, path, "\n")
+	_, err = OpenIndexed(path)
+	assert.Equal(t, ErrIndexStale, err)
+
+	// the snapshot of a mixed AOF is the state before the first line
+	path = filepath.Join(dir, "mixed.aof")
+	writeFiles(t, dir, map[string]string{"mixed.aof": mixedAOF("2\nk 1\nl 0\nCREATE l 2\nMODIFY k +1\n")})
+	assert.Nil(t, BuildOffsetIndex(path, OffsetIndexOptions{Interval: 2, CheckpointInterval: 4}))
+	a, err = OpenIndexed(path)
+	assert.Nil(t, err)
+	defer a.Close()
+	assert.Equal(t, 2, a.Lines)
+	text, err = a.ReadLine(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE l 2", text)
+	state, err = a.StateAt(0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"k": 10, "j": 1, "l": 2}, state)
+	state, err = a.StateAt(1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"k": 11, "j": 1, "l": 2}, state)
+}
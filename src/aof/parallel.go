@@ -0,0 +1,362 @@
+package aof
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CompactParallel writes the same AOF as Compact, with the body of a seekable
+// input split at line boundaries into chunks that are parsed by workers at
+// once. The keys are partitioned by hash between the workers, which chain the
+// states the chunks leave to every key. Inputs the workers do not handle, like
+// checksummed or mixed AOFs, and any error fall back to Compact, so errors are
+// the ones it reports. The caller closes w.
+func CompactParallel(w *Writer, rs io.ReadSeeker, workers int) error {
+	base, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	ra, ok := rs.(io.ReaderAt)
+	if workers > 1 && ok {
+		final, ok, err := compactChunks(rs, ra, base, workers)
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, event := range final {
+				if err := w.Create(event.Key, event.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if _, err := rs.Seek(base, io.SeekStart); err != nil {
+		return err
+	}
+	return Compact(w, rs)
+}
+
+// plainFields splits a line ending with an optional \r\n or \n into its fields.
+// It accepts only the lines the lexer splits the same way: valid UTF-8, fields
+// separated by spaces and tabs, without leading or trailing ones.
+func plainFields(line string) ([]string, bool) {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" || !utf8.ValidString(line) || strings.ContainsAny(line, "\r\n") {
+		return nil, false
+	}
+
+	if isSpace(rune(line[0])) || isSpace(rune(line[len(line)-1])) {
+		return nil, false
+	}
+
+	fields := strings.FieldsFunc(line, func(r rune) bool { return isSpace(r) })
+	for _, field := range fields {
+		// checksums and spaces the lexer does not split on
+		if strings.HasPrefix(field, "#") || strings.IndexFunc(field, unicode.IsSpace) >= 0 {
+			return nil, false
+		}
+	}
+	return fields, true
+}
+
+// chunkHeaders reads the header or the footer index of the input and returns
+// the last lines of the keys and the range of the body, relative to base
+func chunkHeaders(rs io.ReadSeeker, ra io.ReaderAt, base int64) (map[string]int, int64, int64, bool, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if n, _ := ra.ReadAt(magic, base); n == len(magic) && string(magic) == snapshotMagic {
+		return nil, 0, 0, false, nil
+	}
+
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	end -= base
+
+	rd := bufio.NewReader(io.NewSectionReader(ra, base, end))
+	line, err := rd.ReadString('\n')
+	fields, valid := plainFields(line)
+	if err != nil || !valid || len(fields) != 1 {
+		return nil, 0, 0, false, nil
+	}
+	start := int64(len(line))
+
+	if fields[0] == footerMarker {
+		offset, err := footerOffset(rs, base)
+		if err != nil {
+			return nil, 0, 0, false, nil
+		}
+		if _, err := rs.Seek(base+offset, io.SeekStart); err != nil {
+			return nil, 0, 0, false, err
+		}
+		_, headers, err := readFooterIndex(bufio.NewReader(rs))
+		if err != nil || offset < start {
+			return nil, 0, 0, false, nil
+		}
+		return headers, start, offset, true, nil
+	}
+
+	total, err := strconv.Atoi(fields[0])
+	if err != nil || total <= 0 {
+		return nil, 0, 0, false, nil
+	}
+	headers := make(map[string]int)
+	for i := 0; i < total; i++ {
+		line, err := rd.ReadString('\n')
+		fields, valid := plainFields(line)
+		if err != nil || !valid || len(fields) != 2 {
+			return nil, 0, 0, false, nil
+		}
+		lastLine, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil || lastLine < 0 {
+			return nil, 0, 0, false, nil
+		}
+		headers[fields[0]] = int(lastLine)
+		start += int64(len(line))
+	}
+	return headers, start, end, true, nil
+}
+
+// chunkKey is what a chunk does to a key: its first record, which needs the
+// state of the key before the chunk, and the state after its records. While
+// the chunk only modifies the key, the value is the sum of the deltas.
+type chunkKey struct {
+	first    dbRecord
+	lastLine int
+	v        value
+	relative bool
+}
+
+type chunk struct {
+	lines   int
+	failed  bool // the line after the parsed ones cannot be compacted in parallel
+	trailer bool // the failed line is a trailer record
+	keys    []map[string]*chunkKey
+	readErr error
+}
+
+func isLineSpace(r rune) bool {
+	return isSpace(r) || isEOL(r)
+}
+
+// keyPartition returns the worker of a key, from its FNV-1a hash
+func keyPartition(key string, workers int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(workers))
+}
+
+// parseChunk parses the lines that start in [from, to) of the body in [start, end)
+func parseChunk(ra io.ReaderAt, start, from, to, end int64, headers map[string]int, workers int) *chunk {
+	c := &chunk{keys: make([]map[string]*chunkKey, workers)}
+	for i := range c.keys {
+		c.keys[i] = make(map[string]*chunkKey)
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(ra, from, end-from))
+	offset := from
+	if from > start {
+		// the chunk starts after the end of the line that crosses its boundary
+		offset--
+		rd = bufio.NewReader(io.NewSectionReader(ra, offset, end-offset))
+		skip, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			c.readErr = err
+			return c
+		}
+		offset += int64(len(skip))
+	}
+
+	for offset < to {
+		line, err := rd.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err != io.EOF {
+				c.readErr = err
+			}
+			return c
+		}
+		offset += int64(len(line))
+
+		fields, valid := plainFields(line)
+		var r dbRecord
+		if valid {
+			r, err = parseRecord(line)
+		}
+		if _, declared := headers[r.key]; !valid || err != nil || !declared ||
+			(r.typ == EventModify && !strings.HasPrefix(fields[2], "+") && !strings.HasPrefix(fields[2], "-")) {
+			c.failed = true
+			first := strings.FieldsFunc(line, isLineSpace)
+			c.trailer = len(first) > 0 && strings.ToUpper(first[0]) == trailerRecord
+			return c
+		}
+
+		keys := c.keys[keyPartition(r.key, workers)]
+		k, exists := keys[r.key]
+		if !exists {
+			k = &chunkKey{first: r, relative: r.typ == EventModify}
+			if k.relative {
+				k.v = value{val: r.arg}
+			} else {
+				k.v, _ = applyEvent(r.typ, r.key, r.arg, value{}, r.typ != EventCreate)
+			}
+			keys[r.key] = k
+		} else {
+			if k.v, err = applyEvent(r.typ, r.key, r.arg, k.v, true); err != nil {
+				c.failed = true
+				return c
+			}
+			k.relative = k.relative && r.typ == EventModify
+		}
+		k.lastLine = c.lines
+		c.lines++
+	}
+	return c
+}
+
+// compactChunks returns the final events of the live keys in the order of
+// their lines, or false when the input has to be compacted by Compact
+func compactChunks(rs io.ReadSeeker, ra io.ReaderAt, base int64, workers int) ([]Event, bool, error) {
+	headers, start, end, ok, err := chunkHeaders(rs, ra, base)
+	if err != nil || !ok || len(headers) == 0 {
+		return nil, false, err
+	}
+	lastValidLine := -1
+	for _, lastLine := range headers {
+		if lastLine > lastValidLine {
+			lastValidLine = lastLine
+		}
+	}
+
+	chunks := make([]*chunk, workers)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		from := start + (end-start)*int64(i)/int64(workers)
+		to := start + (end-start)*int64(i+1)/int64(workers)
+		wg.Add(1)
+		go func(i int, from, to int64) {
+			defer wg.Done()
+			chunks[i] = parseChunk(io.NewSectionReader(ra, base, end), start, from, to, end, headers, workers)
+		}(i, from, to)
+	}
+	wg.Wait()
+
+	// the first line of every chunk; lines after the last declared line are not parsed
+	firstLines := make([]int, 0, workers)
+	lines := 0
+	for _, c := range chunks {
+		if c.readErr != nil {
+			return nil, false, c.readErr
+		}
+		firstLines = append(firstLines, lines)
+		lines += c.lines
+		if c.failed {
+			// the parser rejects a trailer right after a body without checksums
+			if lines <= lastValidLine || (c.trailer && lines == lastValidLine+1) {
+				return nil, false, nil
+			}
+			break
+		}
+	}
+	if lines <= lastValidLine {
+		return nil, false, nil
+	}
+	chunks = chunks[:len(firstLines)]
+
+	finals := make([][]Event, workers)
+	valid := make([]bool, workers)
+	for i := range finals {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			finals[i], valid[i] = mergeChunks(chunks, firstLines, i, headers)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, v := range valid {
+		if !v {
+			return nil, false, nil
+		}
+	}
+	return mergeFinals(finals), true, nil
+}
+
+type chunkState struct {
+	v        value
+	lastLine int
+}
+
+// mergeChunks chains the chunks of the keys of a worker and returns the final
+// events of its live keys in the order of their lines. It fails when a record
+// does not fit the state before it or a key is used after its declared last line.
+func mergeChunks(chunks []*chunk, firstLines []int, worker int, headers map[string]int) ([]Event, bool) {
+	states := make(map[string]*chunkState)
+	for i, c := range chunks {
+		for key, k := range c.keys[worker] {
+			s, exists := states[key]
+			if !exists {
+				s = &chunkState{}
+				states[key] = s
+			}
+			v, err := applyEvent(k.first.typ, key, k.first.arg, s.v, exists)
+			if err != nil {
+				return nil, false
+			}
+			if k.relative {
+				v.val = s.v.val + k.v.val
+			} else {
+				v = k.v
+			}
+			s.v = v
+			s.lastLine = firstLines[i] + k.lastLine
+		}
+	}
+
+	final := []Event{}
+	for key, s := range states {
+		if s.lastLine > headers[key] {
+			return nil, false
+		} else if s.lastLine == headers[key] && !s.v.deleted {
+			final = append(final, Event{Type: EventFinal, Key: key, Value: s.v.val, Line: s.lastLine})
+		}
+	}
+	sort.Sort(eventsByLine(final))
+	return final, true
+}
+
+type eventsByLine []Event
+
+func (s eventsByLine) Len() int           { return len(s) }
+func (s eventsByLine) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s eventsByLine) Less(i, j int) bool { return s[i].Line < s[j].Line }
+
+// mergeFinals merges the final events of the workers in the order of their lines
+func mergeFinals(finals [][]Event) []Event {
+	merged := []Event{}
+	for {
+		next := -1
+		for i, events := range finals {
+			if len(events) > 0 && (next < 0 || events[0].Line < finals[next][0].Line) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return merged
+		}
+		merged = append(merged, finals[next][0])
+		finals[next] = finals[next][1:]
+	}
+}
@@ -0,0 +1,47 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactParallel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, footer := range []bool{false, true} {
+		for _, checksums := range []bool{false, true} {
+			for _, lines := range []int{1, 7, 500} {
+				data := randomAOF(rnd, footer, checksums, lines)
+				rd := bytes.NewReader(data)
+				_, parallel, err := compactChunks(rd, rd, 0, 4)
+				assert.Nil(t, err)
+				assert.Equal(t, !checksums, parallel)
+			}
+		}
+	}
+
+	corpus := compactCorpus(rnd)
+	for _, workers := range []int{1, 2, 3, 8, 64} {
+		checkCompactor(t, corpus, func(w *Writer, rd io.Reader) error {
+			return CompactParallel(w, rd.(io.ReadSeeker), workers)
+		})
+	}
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	data := "3\na 3\nb 4\nc 2\nCREATE a 1\nCREATE b 2\nCREATE c 3\nMODIFY a +4\nDELETE b\n"
+	for workers := 2; workers <= len(data); workers++ {
+		checkCompactor(t, [][]byte{[]byte(data)}, func(w *Writer, rd io.Reader) error {
+			return CompactParallel(w, rd.(io.ReadSeeker), workers)
+		})
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	assert.Nil(t, CompactParallel(w, bytes.NewReader([]byte(data)), 3))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "2\nc 0\na 1\nCREATE c 3\nCREATE a 5\n", out.String())
+}
@@ -1,9 +1,10 @@
 package aof
 
 import (
-	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -34,11 +35,20 @@ var events2str = map[EventType]string{
 	EventFinal:     "EventFinal",
 }
 
+const trailerRecord = "TRAILER"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func formatChecksum(sum uint32) string {
+	return fmt.Sprintf("#%08x", sum)
+}
+
 type Event struct {
 	Type    EventType
 	Key     string
 	Value   int
 	Deleted bool
+	Line    int // body line, counted from 0 as in the header
 }
 
 func (e Event) String() string {
@@ -56,6 +66,20 @@ func (e Event) String() string {
 	return fmt.Sprintf("Event{Type: %v%v, Key: %s, Value: %d, Deleted: %v}", evnt, isFinalEvent, e.Key, e.Value, e.Deleted)
 }
 
+// ParseError reports the line of the AOF input that could not be parsed
+type ParseError struct {
+	File string // set for the files of a manifest
+	Line int    // lines start from 1
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("ERROR in %s at line %d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("ERROR at line %d: %s", e.Line, e.Msg)
+}
+
 type parserStateFunc func(*AOFParser) parserStateFunc
 
 type value struct {
@@ -65,14 +89,17 @@ type value struct {
 
 type AOFParser struct {
 	quit   chan struct{}
+	rd     io.Reader
 	lex    *lexer
 	events chan Event
+	done   chan struct{} // closed when Parse returns
 	state  parserStateFunc
 	err    error
 
 	headerTotal   int
 	headers       map[string]int
-	values        map[string]value
+	store         Store
+	initial       map[string]int // the values of WithSnapshot, put in the store when the parse starts
 	curHeaderLine int
 	curBodyLine   int
 	lastValidLine int
@@ -81,17 +108,71 @@ type AOFParser struct {
 	curKey   string
 	curDelta int
 	curValue int
+
+	backup     *token
+	lineTokens []string
+	checksums  bool
+	rolling    uint32
+
+	indexed      bool
+	snapshotKeys []string // of the binary snapshot of a mixed AOF, in its order
+	snapshot     map[string]int
+	untouched    []string // the snapshot keys the header does not declare
+	headerSize   int64    // approximate bytes of the header keys and of the snapshot, set by emitHeader
+	noHeader     bool     // the input starts with a word instead of the header total
+
+	// raw body events carry the value or the delta of their line, the
+	// state of the keys is left to the consumer
+	raw bool
+
+	// the state of a key is dropped once its final line is parsed
+	evict    bool
+	finished map[uint64]struct{} // the 64-bit hash of every dropped key
+	dropped  int                 // keys dropped since the headers were last rebuilt
+
+	// the files of a manifest are replayed one after the other
+	files      []string
+	fileIndex  int
+	file       io.Closer
+	lastFile   map[string]int // the index of the last file that uses a key
+	lineOffset int            // body lines of the files before the current one
+	headerSent bool
+
+	follow bool
+	reset  bool // the followed file was truncated or replaced
 }
 
-func NewAOFParser(rd io.Reader) *AOFParser {
+type ParserOption func(*AOFParser)
+
+// WithSnapshot starts the replay from the values of a compacted snapshot, so
+// the body can SET, MODIFY and DELETE its keys without creating them
+func WithSnapshot(values map[string]int) ParserOption {
+	return func(p *AOFParser) {
+		if p.initial == nil {
+			p.initial = make(map[string]int)
+		}
+		for key, val := range values {
+			p.initial[key] = val
+		}
+	}
+}
+
+func NewAOFParser(rd io.Reader, opts ...ParserOption) *AOFParser {
 	quit := make(chan struct{})
-	return &AOFParser{
+	p := &AOFParser{
 		quit:    quit,
+		rd:      rd,
 		lex:     newLexer(quit, rd),
 		events:  make(chan Event),
+		done:    make(chan struct{}),
 		headers: make(map[string]int),
-		values:  make(map[string]value),
+		store:   NewMapStore(),
+		evict:   true,
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	return p
 }
 
 func newEvent(typ EventType) Event {
@@ -99,9 +180,27 @@ func newEvent(typ EventType) Event {
 }
 
 func (p *AOFParser) error(format string, args ...interface{}) {
-	prefix := fmt.Sprintf("ERROR at line %d: ", p.curHeaderLine+p.curBodyLine+1) // lines start from 1
-	p.err = errors.New(prefix + fmt.Sprintf(format, args...))
-	p.emit(Event{Type: EventError, Key: p.curKey, Value: p.curValue, Deleted: p.values[p.curKey].deleted})
+	p.errorAt(p.curBodyLine, format, args...)
+}
+
+// errorAt reports an error at a body line of the current file
+func (p *AOFParser) errorAt(bodyLine int, format string, args ...interface{}) {
+	p.err = &ParseError{Line: p.curHeaderLine + bodyLine + 1, Msg: fmt.Sprintf(format, args...)}
+	if p.files != nil {
+		p.err.(*ParseError).File = filepath.Base(p.files[p.fileIndex])
+	}
+	v, _, _ := p.store.Get(p.curKey)
+	p.emit(Event{Type: EventError, Key: p.curKey, Value: p.curValue, Deleted: v.Deleted})
+}
+
+// getValue returns the state of a key from the store
+func (p *AOFParser) getValue(key string) (value, bool, error) {
+	v, exists, err := p.store.Get(key)
+	return value{val: v.Value, deleted: v.Deleted}, exists, err
+}
+
+func (p *AOFParser) putValue(key string, v value) error {
+	return p.store.Put(key, StoreValue{Value: v.val, Deleted: v.deleted})
 }
 
 func (p *AOFParser) nextNonSpace() (t token) {
@@ -111,6 +210,10 @@ func (p *AOFParser) nextNonSpace() (t token) {
 			break
 		}
 	}
+
+	if t.typ == tokenString || t.typ == tokenNumber {
+		p.lineTokens = append(p.lineTokens, t.val)
+	}
 	return t
 }
 
@@ -135,7 +238,11 @@ func (p *AOFParser) expectOneOf(expectedValues ...tokenType) token {
 }
 
 func (p *AOFParser) unexpected(actual tokenType, expected ...tokenType) {
-	if len(expected) == 1 {
+	if actual == tokenError && p.lex.err == errFollowReset {
+		p.reset = true
+	} else if actual == tokenError && p.lex.err != nil {
+		p.error("%v", p.lex.err)
+	} else if len(expected) == 1 {
 		p.error("Unexpected token: %v, expected %v", actual, expected[0])
 	} else {
 		p.error("Unexpected token: %v, expected one of %v", actual, expected)
@@ -143,16 +250,24 @@ func (p *AOFParser) unexpected(actual tokenType, expected ...tokenType) {
 }
 
 func aofHeaderTotal(p *AOFParser) parserStateFunc {
-	token := p.expect(tokenNumber)
-	if token.typ != tokenNumber {
+	token := p.nextNonSpace()
+	if token.typ == tokenString && token.val == footerMarker {
+		return aofFooterMarker
+	} else if token.typ == tokenString && p.follow {
+		// a followed stream may have no header at all
+		p.backup = &token
+		p.emitHeader()
+		return aofBodyEvent
+	} else if token.typ != tokenNumber {
+		p.noHeader = token.typ == tokenString
+		p.unexpected(token.typ, tokenNumber)
 		return nil
 	}
 
 	i64, _ := strconv.ParseInt(token.val, 10, 64)
 	p.headerTotal = int(i64)
 	if p.headerTotal <= 0 {
-		p.emit(newEvent(EventCompleted))
-		return nil
+		return aofCompleted
 	}
 
 	p.expect(tokenEOL)
@@ -186,18 +301,25 @@ func aofHeader(p *AOFParser) parserStateFunc {
 		p.curHeaderLine++
 	}
 
-	p.emit(newEvent(EventHeader))
+	// only the tokens of body lines are checksummed, the header ones would stay referenced
+	p.lineTokens = nil
+	p.emitHeader()
 
 	return aofBodyEvent
 }
 
 func aofBodyEvent(p *AOFParser) parserStateFunc {
+	p.lineTokens = p.lineTokens[:0]
 	rawEvent := p.expect(tokenString)
 	if rawEvent.typ != tokenString {
 		return nil
 	}
 
 	action := strings.ToUpper(rawEvent.val)
+	if p.follow && (action == trailerRecord || action == footerIndex) {
+		return aofFollowIdle
+	}
+
 	switch action {
 	case "CREATE":
 		p.curEvent = EventCreate
@@ -227,7 +349,7 @@ func aofBodyKey(p *AOFParser) parserStateFunc {
 	} else if p.curEvent == EventModify {
 		return aofBodyModifyOperator
 	} else {
-		return aofEmitBodyEvent
+		return aofBodyChecksum
 	}
 }
 
@@ -240,7 +362,7 @@ func aofBodyValue(p *AOFParser) parserStateFunc {
 	v64, _ := strconv.ParseInt(rawValue.val, 10, 64)
 	p.curValue = int(v64)
 
-	return aofEmitBodyEvent
+	return aofBodyChecksum
 }
 
 func aofBodyModifyOperator(p *AOFParser) parserStateFunc {
@@ -257,72 +379,177 @@ func aofBodyModifyOperator(p *AOFParser) parserStateFunc {
 	v64, _ := strconv.ParseInt(rawDelta.val, 10, 64)
 	p.curDelta = int(v64)
 
-	return aofEmitBodyEvent
+	return aofBodyChecksum
 }
 
-func aofEmitBodyEvent(p *AOFParser) parserStateFunc {
+// aofBodyChecksum verifies the optional CRC32C column of a body line.
+// Once a line carries one, every line of the body must, and the body must
+// end with a trailer.
+func aofBodyChecksum(p *AOFParser) parserStateFunc {
+	line := strings.Join(p.lineTokens, " ")
 
-	// check different rules
-	if _, exists := p.headers[p.curKey]; !exists {
-		p.error("Key '%s' was not defined in the header", p.curKey)
+	t := p.nextNonSpace()
+	hasChecksum := t.typ == tokenString && strings.HasPrefix(t.val, "#")
+	if !hasChecksum {
+		p.backup = &t
+	}
+
+	if p.curBodyLine == 0 {
+		p.checksums = hasChecksum
+	} else if hasChecksum != p.checksums {
+		// the checksums of the lines before were removed
+		if !p.checksums {
+			p.errorAt(0, "Missing checksum")
+		} else {
+			p.error("Missing checksum")
+		}
 		return nil
 	}
 
-	switch p.curEvent {
+	if !p.checksums {
+		return aofEmitBodyEvent
+	}
+
+	if t.val != formatChecksum(crc32.Checksum([]byte(line), castagnoli)) {
+		p.error("Checksum mismatch: %s", t.val)
+		return nil
+	}
+	p.rolling = crc32.Update(p.rolling, castagnoli, []byte(line+"\n"))
+
+	return aofEmitBodyEvent
+}
+
+// applyEvent applies a body event to the current state of a key. arg is the new value or the MODIFY delta.
+func applyEvent(typ EventType, key string, arg int, v value, exists bool) (value, error) {
+	switch typ {
 	case EventCreate:
-		v, exists := p.values[p.curKey]
 		if exists && !v.deleted {
-			p.error("Key '%s' has already been created", p.curKey)
-			return nil
+			return v, fmt.Errorf("Key '%s' has already been created", key)
 		}
-
-		p.values[p.curKey] = value{val: p.curValue, deleted: false}
+		return value{val: arg, deleted: false}, nil
 
 	case EventSet:
-		v, exists := p.values[p.curKey]
 		if !exists || v.deleted {
-			p.error("Key '%s' was not created", p.curKey)
-			return nil
+			return v, fmt.Errorf("Key '%s' was not created", key)
 		}
-
-		p.values[p.curKey] = value{val: p.curValue, deleted: false}
+		return value{val: arg, deleted: false}, nil
 
 	case EventModify:
-		v, exists := p.values[p.curKey]
 		if !exists || v.deleted {
-			p.error("Key '%s' was not created", p.curKey)
-			return nil
+			return v, fmt.Errorf("Key '%s' was not created", key)
 		}
-
-		v.val = v.val + p.curDelta
-		p.values[p.curKey] = v
+		v.val = v.val + arg
+		return v, nil
 
 	case EventDelete:
-		v, exists := p.values[p.curKey]
 		if !exists {
-			p.error("Key '%s' was not created", p.curKey)
-			return nil
+			return v, fmt.Errorf("Key '%s' was not created", key)
 		} else if v.deleted {
-			p.error("Key '%s' has been deleted", p.curKey)
-			return nil
+			return v, fmt.Errorf("Key '%s' has been deleted", key)
 		}
-
 		v.deleted = true
-		p.values[p.curKey] = v
+		return v, nil
+	}
+	return v, fmt.Errorf("Unknown event: %v", typ)
+}
+
+func aofEmitBodyEvent(p *AOFParser) parserStateFunc {
+
+	// check different rules
+	lastLine, declared := p.headers[p.curKey]
+	if !p.follow && ((declared && p.curBodyLine > lastLine) || (!declared && p.wasFinished(p.curKey))) {
+		p.error("Key '%s' was used after its declared last line", p.curKey)
+		return nil
+	} else if !declared && !p.follow {
+		p.error("Key '%s' was not defined in the header", p.curKey)
+		return nil
+	}
+
+	arg := p.curValue
+	if p.curEvent == EventModify {
+		arg = p.curDelta
+	}
+
+	v := value{val: arg, deleted: p.curEvent == EventDelete}
+	if !p.raw {
+		old, exists, err := p.getValue(p.curKey)
+		if err == nil {
+			v, err = applyEvent(p.curEvent, p.curKey, arg, old, exists)
+		}
+		if err == nil {
+			err = p.putValue(p.curKey, v)
+		}
+		if err != nil {
+			p.error("%v", err)
+			return nil
+		}
 	}
 
 	// send event to consumer
 	var eventType = p.curEvent
-	if p.headers[p.curKey] == p.curBodyLine {
+	if p.headers[p.curKey] == p.curBodyLine && p.lastFile[p.curKey] == p.fileIndex && !p.follow {
 		eventType |= EventFinal
 	}
-	p.emit(Event{Type: eventType, Key: p.curKey, Value: p.values[p.curKey].val, Deleted: p.values[p.curKey].deleted})
+	p.emit(Event{Type: eventType, Key: p.curKey, Value: v.val, Deleted: v.deleted, Line: p.lineOffset + p.curBodyLine})
+
+	if eventType&EventFinal == EventFinal && p.evict {
+		if err := p.finish(p.curKey); err != nil {
+			p.error("%v", err)
+			return nil
+		}
+	}
 
 	return aofBodyNextLine
 }
 
+// finish drops the state of a key after its final line. Only a 64-bit hash of
+// the key is kept, to tell a key used after its last line from an undeclared
+// one, so the set holds at most one small entry per key of the header.
+func (p *AOFParser) finish(key string) error {
+	if p.finished == nil {
+		p.finished = make(map[uint64]struct{})
+	}
+	p.finished[keyHash(key)] = struct{}{}
+	delete(p.headers, key)
+
+	// maps keep their size after deletes, so the headers are rebuilt once most of them is gone
+	if p.dropped++; p.dropped >= 1024 && p.dropped > len(p.headers) {
+		headers := make(map[string]int, len(p.headers))
+		for key, lastLine := range p.headers {
+			headers[key] = lastLine
+		}
+		p.headers = headers
+		p.dropped = 0
+	}
+	return p.store.Delete(key)
+}
+
+// wasFinished tells whether a key was dropped. Only another key with the same
+// 64-bit hash makes an undeclared key look dropped, both are errors.
+func (p *AOFParser) wasFinished(key string) bool {
+	_, finished := p.finished[keyHash(key)]
+	return finished
+}
+
+// keyHash returns the 64-bit FNV-1a hash of a key
+func keyHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
 func aofBodyNextLine(p *AOFParser) parserStateFunc {
 	p.curBodyLine++
+	if p.follow {
+		if p.expect(tokenEOL).typ != tokenEOL {
+			return nil
+		}
+		return aofBodyEvent
+	}
+
 	if p.curBodyLine <= p.lastValidLine {
 		t := p.expectOneOf(tokenEOL, tokenEOF)
 		if t.typ == tokenEOF && p.curBodyLine < p.lastValidLine {
@@ -333,19 +560,107 @@ func aofBodyNextLine(p *AOFParser) parserStateFunc {
 		}
 	}
 
-	p.emit(newEvent(EventCompleted))
-	return nil
+	if p.checksums {
+		return aofTrailer
+	}
+
+	return aofNoTrailer
+}
+
+// aofNoTrailer rejects a trailer after a body without checksums, the checksums were removed
+func aofNoTrailer(p *AOFParser) parserStateFunc {
+	if p.nextNonSpace().typ != tokenEOL {
+		return aofCompleted
+	}
+	if t := p.next(); t.typ == tokenString && strings.ToUpper(t.val) == trailerRecord {
+		p.error("Missing checksum, the body has a trailer")
+		return nil
+	}
+	return aofCompleted
+}
+
+// aofTrailer verifies the TRAILER record that follows the body of a checksummed AOF
+func aofTrailer(p *AOFParser) parserStateFunc {
+	if p.expect(tokenEOL).typ != tokenEOL {
+		return nil
+	}
+
+	t := p.expectOneOf(tokenString, tokenEOF)
+	if t.typ == tokenEOF {
+		p.error("Missing trailer")
+		return nil
+	} else if t.typ != tokenString {
+		return nil
+	} else if t.val != trailerRecord {
+		p.error("Unknown trailer: %s", t.val)
+		return nil
+	}
+
+	rawLines := p.expect(tokenNumber)
+	if rawLines.typ != tokenNumber {
+		return nil
+	}
+	if lines, _ := strconv.ParseInt(rawLines.val, 10, 64); int(lines) != p.curBodyLine {
+		p.error("Trailer line count mismatch: %s, expected %d", rawLines.val, p.curBodyLine)
+		return nil
+	}
+
+	rawChecksum := p.expect(tokenString)
+	if rawChecksum.typ != tokenString {
+		return nil
+	}
+	if rawChecksum.val != formatChecksum(p.rolling) {
+		p.error("Trailer checksum mismatch: %s", rawChecksum.val)
+		return nil
+	}
+
+	return aofCompleted
+}
+
+// aofCompleted ends the input, unless more files of a manifest follow
+func aofCompleted(p *AOFParser) parserStateFunc {
+	if p.follow {
+		return aofFollowIdle
+	}
+	if p.fileIndex+1 >= len(p.files) {
+		p.emit(newEvent(EventCompleted))
+		return nil
+	}
+
+	p.lineOffset += p.curBodyLine
+	p.fileIndex++
+	return aofNextFile
+}
+
+func (p *AOFParser) emitHeader() {
+	if !p.headerSent {
+		p.headerSent = true
+		for _, key := range p.snapshotKeys {
+			if _, used := p.headers[key]; !used {
+				p.untouched = append(p.untouched, key)
+			}
+			p.headerSize += keySize(key)
+		}
+		for key := range p.headers {
+			p.headerSize += keySize(key)
+		}
+		p.emit(newEvent(EventHeader))
+	}
 }
 
 func (p *AOFParser) emit(event Event) {
 	select {
 	case p.events <- event:
 	case <-p.quit:
-		close(p.events)
 	}
 }
 
 func (p *AOFParser) next() token {
+	if p.backup != nil {
+		t := *p.backup
+		p.backup = nil
+		return t
+	}
 	return p.lex.nextToken()
 }
 
@@ -354,7 +669,6 @@ func (p *AOFParser) NextEvent() Event {
 	case event := <-p.events:
 		return event
 	case <-p.quit:
-		close(p.events)
 		return newEvent(EventQuit)
 	}
 }
@@ -368,9 +682,65 @@ func (p *AOFParser) Error() error {
 }
 
 func (p *AOFParser) Parse() {
-	go p.lex.run()
+	defer close(p.done)
+	p.state = aofHeaderTotal
+	if err := p.seed(); err != nil {
+		p.error("%v", err)
+		return
+	}
+	if p.files != nil {
+		p.state = aofNextFile
+	} else if err := p.start(); err != nil {
+		p.error("%v", err)
+		return
+	}
 
-	for p.state = aofHeaderTotal; p.state != nil; {
-		p.state = p.state(p)
+	for {
+		for p.state != nil {
+			p.state = p.state(p)
+		}
+		if !p.reset {
+			break
+		}
+		if err := p.restart(); err != nil {
+			p.error("%v", err)
+			break
+		}
+	}
+
+	p.lex.wait()
+	if p.file != nil {
+		p.file.Close()
 	}
 }
+
+// stop quits the parser and returns once Parse returned and no longer reads the input
+func (p *AOFParser) stop() {
+	p.Quit()
+	<-p.done
+}
+
+// seed puts the values of WithSnapshot in the store
+func (p *AOFParser) seed() error {
+	for key, val := range p.initial {
+		if err := p.putValue(key, value{val: val}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start loads the footer index of a seekable input and starts the lexer
+func (p *AOFParser) start() error {
+	if err := p.readSnapshot(); err != nil {
+		return err
+	}
+	if rs, ok := p.rd.(io.ReadSeeker); ok {
+		if err := p.readFooter(rs); err != nil {
+			return err
+		}
+	}
+
+	p.lex.start()
+	return nil
+}
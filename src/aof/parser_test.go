@@ -1,6 +1,7 @@
 package aof
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"testing"
@@ -429,3 +430,198 @@ MODIFY  key5 -1
 	}
 
 }
+
+func TestParserChecksums(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Checksums = true
+	w.Create("key1", 1)
+	w.Create("key2", 2)
+	w.Modify("key1", 10)
+	w.Close()
+	valid := buf.String()
+	lines := strings.Split(valid, "\n")
+
+	tests := []struct {
+		aof string
+		err string
+	}{
+		{aof: valid},
+		{
+			aof: strings.Replace(valid, "CREATE key2 2", "CREATE key2 3", 1),
+			err: "ERROR at line 5: Checksum mismatch: #",
+		},
+		{
+			aof: strings.Replace(valid, "MODIFY key1 +10 #", "MODIFY key1 +10 ##", 1),
+			err: "ERROR at line 6: Checksum mismatch: ##",
+		},
+		{
+			aof: strings.Replace(valid, lines[4], "CREATE key2 2", 1),
+			err: "ERROR at line 5: Missing checksum",
+		},
+		{
+			aof: valid[:strings.Index(valid, "TRAILER")],
+			err: "ERROR at line 7: Missing trailer",
+		},
+		{
+			aof: strings.Replace(valid, "TRAILER 3", "TRAILER 4", 1),
+			err: "ERROR at line 7: Trailer line count mismatch: 4, expected 3",
+		},
+		{
+			aof: valid[:strings.Index(valid, "TRAILER")] + "TRAILER 3 #00000000\n",
+			err: "ERROR at line 7: Trailer checksum mismatch: #00000000",
+		},
+		{
+			aof: "2\nkey1 0\nkey2 1\nCREATE key1 1 #00000000\nCREATE key2 2\n",
+			err: "ERROR at line 4: Checksum mismatch: #00000000",
+		},
+		{
+			// only the first checksum was removed
+			aof: strings.Replace(valid, lines[3], "CREATE key1 1", 1),
+			err: "ERROR at line 4: Missing checksum",
+		},
+		{
+			aof: strings.Join([]string{lines[0], lines[1], lines[2], "CREATE key1 1", "CREATE key2 2", "MODIFY key1 +10", lines[6], ""}, "\n"),
+			err: "ERROR at line 7: Missing checksum, the body has a trailer",
+		},
+		{
+			aof: "2\nkey1 0\nkey2 1\nCREATE key1 1\nCREATE key2 2\nMORE\n",
+		},
+	}
+
+	for i, test := range tests {
+		_, err := ReadState(strings.NewReader(test.aof))
+		if test.err == "" {
+			assert.Nil(t, err, "test %d", i)
+			continue
+		}
+
+		if assert.NotNil(t, err, "test %d", i) {
+			assert.True(t, strings.HasPrefix(err.Error(), test.err), "%d) %s", i, err)
+			parseErr, ok := err.(*ParseError)
+			assert.True(t, ok)
+			assert.Equal(t, test.err[len("ERROR at line "):][:1], fmt.Sprint(parseErr.Line))
+		}
+	}
+}
+
+func TestParserEviction(t *testing.T) {
+	p := NewAOFParser(strings.NewReader("3\na 1\nb 3\nc 2\nCREATE a 1\nMODIFY a +1\nCREATE c 3\nCREATE b 2\n"))
+	lastLines := map[string]int{}
+	err := replay(p, func(event Event) error {
+		if event.Type&EventFinal == EventFinal {
+			lastLines[event.Key] = event.Line
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 3, "c": 2}, lastLines)
+	assert.Empty(t, p.store.(*MapStore).values)
+	assert.Empty(t, p.headers)
+
+	tests := []struct {
+		aof string
+		err string
+	}{
+		{
+			// a is dropped after line 0
+			aof: "3\na 0\nb 1\nc 2\nCREATE a 1\nCREATE b 2\nSET a 3\n",
+			err: "ERROR at line 7: Key 'a' was used after its declared last line",
+		},
+		{
+			// line 1 is not a line of a, it is still declared
+			aof: "2\na 1\nb 2\nCREATE a 1\nCREATE b 2\nSET a 3\n",
+			err: "ERROR at line 6: Key 'a' was used after its declared last line",
+		},
+		{
+			aof: "2\na 0\nb 1\nCREATE a 1\nCREATE c 2\n",
+			err: "ERROR at line 5: Key 'c' was not defined in the header",
+		},
+	}
+	for i, test := range tests {
+		_, err := ReadState(strings.NewReader(test.aof))
+		assert.EqualError(t, err, test.err, "test %d", i)
+	}
+
+	// an undeclared key is told from a dropped one with the same short hash
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("c%d", i); keyPartition(key, 1<<16) == keyPartition("a", 1<<16) {
+			other = key
+		}
+	}
+	_, err = ReadState(strings.NewReader("2\na 0\nb 1\nCREATE a 1\nCREATE " + other + " 2\n"))
+	assert.EqualError(t, err, "ERROR at line 5: Key '"+other+"' was not defined in the header")
+}
+
+// memoryAOF returns an AOF of n keys that are each live for window lines
+func memoryAOF(n, window int) string {
+	lines := []string{}
+	lastLines := make([]int, n)
+	for i := 0; i < n+window; i++ {
+		if i < n {
+			lines = append(lines, fmt.Sprintf("CREATE key%d %d", i, i))
+		}
+		if i >= window {
+			lines = append(lines, fmt.Sprintf("DELETE key%d", i-window))
+			lastLines[i-window] = len(lines) - 1
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", n)
+	for i, lastLine := range lastLines {
+		fmt.Fprintf(&buf, "key%d %d\n", i, lastLine)
+	}
+	buf.WriteString(strings.Join(lines, "\n") + "\n")
+	return buf.String()
+}
+
+// peakStore counts the keys a MapStore holds and their size, and keeps the peak
+type peakStore struct {
+	*MapStore
+	keys, size         int
+	peakKeys, peakSize int
+}
+
+func (s *peakStore) Put(key string, v StoreValue) error {
+	if _, exists, _ := s.MapStore.Get(key); !exists {
+		s.keys++
+		s.size += int(keySize(key))
+		if s.keys > s.peakKeys {
+			s.peakKeys, s.peakSize = s.keys, s.size
+		}
+	}
+	return s.MapStore.Put(key, v)
+}
+
+func (s *peakStore) Delete(key string) error {
+	if _, exists, _ := s.MapStore.Get(key); exists {
+		s.keys--
+		s.size -= int(keySize(key))
+	}
+	return s.MapStore.Delete(key)
+}
+
+// BenchmarkParserMemory reports the peak of the key states the parser holds,
+// which follows the number of live keys, not the number of keys of the AOF.
+// The header keys are held from the start whatever the number of live keys.
+func BenchmarkParserMemory(b *testing.B) {
+	const keys = 100000
+	for _, window := range []int{10, 1000, keys} {
+		b.Run(fmt.Sprintf("live=%d", window), func(b *testing.B) {
+			data := memoryAOF(keys, window)
+			var s *peakStore
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s = &peakStore{MapStore: NewMapStore()}
+				p := NewAOFParser(strings.NewReader(data), WithStore(s), WithEviction(true))
+				if err := replay(p, func(Event) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(s.peakKeys), "held-keys")
+			b.ReportMetric(float64(s.peakSize), "held-state-B")
+		})
+	}
+}
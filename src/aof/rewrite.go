@@ -0,0 +1,335 @@
+package aof
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RewritePolicy starts a rewrite once the file grew enough since the last one.
+// All the thresholds that are set must be crossed, and at least one of
+// GrowthPercent and ObsoleteRatio must be set.
+type RewritePolicy struct {
+	GrowthPercent int     // growth of the file since the last rewrite or Open
+	MinSize       int64   // smallest file size to rewrite, in bytes
+	ObsoleteRatio float64 // share of the body lines that are superseded by later ones
+}
+
+// DBStats describes the file of a database and its rewrites
+type DBStats struct {
+	Size             int64 // bytes of the marker and the body
+	BaseSize         int64 // size after the last rewrite or at Open
+	Lines            int
+	ObsoleteLines    int // body lines that are not the last line of a live key
+	Rewriting        bool
+	Rewrites         int
+	LastRewrite      time.Time
+	LastRewriteTook  time.Duration
+	LastRewriteSaved int64 // bytes
+	LastRewriteErr   error
+}
+
+// WithAutoRewrite starts a background rewrite once the policy thresholds are crossed
+func WithAutoRewrite(policy RewritePolicy) DBOption {
+	return func(db *DB) {
+		db.autoRewrite = policy
+	}
+}
+
+var (
+	ErrRewriteInProgress = errors.New("AOF rewrite is already in progress")
+	ErrRewriteAborted    = errors.New("AOF rewrite was aborted, the database is closed")
+)
+
+// a failed rewrite delays the next automatic one by rewriteRetryDelay, doubled
+// after every failure in a row up to rewriteMaxRetryDelay
+const (
+	rewriteRetryDelay    = time.Second
+	rewriteMaxRetryDelay = 5 * time.Minute
+)
+
+// rewriteBatch is the most updates the rewrite appends to the new file while
+// the writers wait; larger backlogs are appended without the lock first.
+const rewriteBatch = 1024
+
+type dbRecord struct {
+	typ EventType
+	key string
+	arg int
+}
+
+// BgRewrite compacts the file in the background while updates continue. The
+// live keys are written to a new file, the updates that arrived meanwhile are
+// appended to it and the new file atomically replaces the old one. The result
+// is sent to the returned channel.
+func (db *DB) BgRewrite() (<-chan error, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	if db.err != nil {
+		return nil, db.err
+	}
+	if db.rewriting {
+		return nil, ErrRewriteInProgress
+	}
+	return db.startRewrite()
+}
+
+// startRewrite takes the snapshot and starts the rewrite. The caller holds db.mu.
+func (db *DB) startRewrite() (<-chan error, error) {
+	if db.manifest != nil {
+		// the updates go to a new incremental file, which the new base does not replace
+		if err := db.rollover(); err != nil {
+			return nil, err
+		}
+	}
+	seq := 0
+	if db.manifest != nil {
+		seq = db.manifest.Seq
+	}
+
+	snapshot := make(map[string]int, db.live)
+	for key, v := range db.values {
+		if !v.deleted {
+			snapshot[key] = v.val
+		}
+	}
+
+	db.rewriting = true
+	db.rewriteBuf = nil
+	db.rewriteDone = make(chan struct{})
+
+	result := make(chan error, 1)
+	go func() {
+		started := db.now()
+		var err error
+		if db.manifest != nil {
+			err = db.rewriteBase(snapshot, seq)
+		} else {
+			err = db.rewrite(snapshot)
+		}
+
+		db.mu.Lock()
+		db.rewriting = false
+		db.rewriteBuf = nil
+		if err == nil {
+			db.stats.LastRewriteErr = nil
+			db.stats.Rewrites++
+			db.stats.LastRewrite = started
+			db.stats.LastRewriteTook = db.now().Sub(started)
+			db.rewriteFailures = 0
+			db.rewriteRetry = time.Time{}
+		} else {
+			db.rewriteFailed(err)
+		}
+		close(db.rewriteDone)
+		db.rewriteDone = nil
+		db.mu.Unlock()
+
+		result <- err
+	}()
+	return result, nil
+}
+
+// rewriteFailed records a failed rewrite and delays the next automatic one. The caller holds db.mu.
+func (db *DB) rewriteFailed(err error) {
+	db.stats.LastRewriteErr = err
+
+	delay := rewriteRetryDelay
+	for i := 0; i < db.rewriteFailures && delay < rewriteMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > rewriteMaxRetryDelay {
+		delay = rewriteMaxRetryDelay
+	}
+	db.rewriteFailures++
+	db.rewriteRetry = db.now().Add(delay)
+}
+
+// needsRewrite tells whether the automatic rewrite thresholds are crossed. The caller holds db.mu.
+func (db *DB) needsRewrite() bool {
+	// without a relative threshold every update would rewrite a large file
+	policy := db.autoRewrite
+	if policy.GrowthPercent <= 0 && policy.ObsoleteRatio <= 0 {
+		return false
+	}
+	// a failing rewrite, on a full disk for one, is not retried on every update
+	if db.now().Before(db.rewriteRetry) {
+		return false
+	}
+
+	size, lines := db.size()
+	if size < policy.MinSize {
+		return false
+	}
+	if policy.GrowthPercent > 0 && size < db.stats.BaseSize+db.stats.BaseSize*int64(policy.GrowthPercent)/100 {
+		return false
+	}
+	if policy.ObsoleteRatio > 0 && (lines == 0 || float64(lines-db.live)/float64(lines) < policy.ObsoleteRatio) {
+		return false
+	}
+	return true
+}
+
+// Stats returns the statistics of the file and of its rewrites
+func (db *DB) Stats() DBStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stats := db.stats
+	stats.Size, stats.Lines = db.size()
+	stats.ObsoleteLines = stats.Lines - db.live
+	stats.Rewriting = db.rewriting
+	return stats
+}
+
+func (db *DB) rewrite(snapshot map[string]int) error {
+	tmpPath := db.path + ".rewrite"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	file := db.wrap(f)
+	swapped := false
+	defer func() {
+		if !swapped {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	w := NewFooterWriter(file)
+	if err := writeSnapshot(w, snapshot); err != nil {
+		return err
+	}
+
+	// sync without the lock, so the final sync under it is short
+	if err := flushAndSync(w, file); err != nil {
+		return err
+	}
+
+	for {
+		db.mu.Lock()
+		if db.closed {
+			db.mu.Unlock()
+			return ErrRewriteAborted
+		}
+
+		batch := db.rewriteBuf
+		db.rewriteBuf = nil
+		if len(batch) <= rewriteBatch {
+			err := db.swap(f, file, w, batch)
+			swapped = err == nil
+			db.mu.Unlock()
+			return err
+		}
+		db.mu.Unlock()
+
+		if err := writeRecords(w, batch); err != nil {
+			return err
+		}
+		if err := flushAndSync(w, file); err != nil {
+			return err
+		}
+	}
+}
+
+func writeSnapshot(w *Writer, snapshot map[string]int) error {
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := w.Create(key, snapshot[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flushAndSync(w *Writer, file dbFile) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func writeRecords(w *Writer, records []dbRecord) error {
+	for _, r := range records {
+		if err := w.writeEvent(r.typ, r.key, r.arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swap appends the last updates to the new file and replaces the old file with it.
+// The caller holds db.mu.
+func (db *DB) swap(f *os.File, file dbFile, w *Writer, batch []dbRecord) error {
+	if db.err != nil {
+		return db.err
+	}
+	db.syncMu.Lock()
+	err := db.syncErr
+	db.syncMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeRecords(w, batch); err != nil {
+		return err
+	}
+	if err := flushAndSync(w, file); err != nil {
+		return err
+	}
+
+	// keep the group commit off the old file
+	db.syncMu.Lock()
+	for db.syncing {
+		db.syncCond.Wait()
+	}
+	db.syncing = true
+	db.syncMu.Unlock()
+
+	err = os.Rename(db.path+".rewrite", db.path)
+
+	old, saved := db.file, db.w.offset-w.offset
+	db.syncMu.Lock()
+	db.syncing = false
+	if err == nil {
+		// every update is in the new file, which is synced
+		db.synced = db.written
+		db.f, db.file, db.w = f, file, w
+	}
+	db.syncCond.Broadcast()
+	db.syncMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(db.path))
+	old.Close()
+
+	db.stats.LastRewriteSaved = saved
+	db.stats.BaseSize = w.offset
+	return nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,240 @@
+package aof
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	return stat.Size()
+}
+
+func TestDBBgRewrite(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "rewrite.aof")
+
+	ff := &faultyFile{}
+	db, err := Open(path, WithSync(SyncNo), withFile(func(f *os.File) dbFile {
+		// the rewrite opens a second file, only the first one is slowed down
+		if ff.f == nil {
+			ff.f = f
+			return ff
+		}
+		return &faultyFile{f: f, syncDelay: 50 * time.Millisecond}
+	}))
+	assert.Nil(t, err)
+
+	const keys = 10
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		assert.Nil(t, db.Create(key, 0))
+		for j := 0; j < 100; j++ {
+			assert.Nil(t, db.Modify(key, 1))
+		}
+	}
+	assert.Nil(t, db.Delete("key0"))
+	before := fileSize(t, path)
+
+	done, err := db.BgRewrite()
+	assert.Nil(t, err)
+	_, err = db.BgRewrite()
+	assert.Equal(t, ErrRewriteInProgress, err)
+
+	// writers keep going during the rewrite
+	var wg sync.WaitGroup
+	for i := 1; i < keys; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.Nil(t, db.Modify(key, 1))
+			}
+		}(fmt.Sprintf("key%d", i))
+	}
+	assert.Nil(t, db.Create("key0", 7))
+	wg.Wait()
+
+	assert.Nil(t, <-done)
+	assert.Nil(t, db.Modify("key1", 1))
+	assert.Nil(t, db.Close())
+	assert.True(t, fileSize(t, path) < before)
+
+	_, err = os.Stat(path + ".rewrite")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	for i := 0; i < keys; i++ {
+		expected := 150
+		if i == 0 {
+			expected = 7
+		} else if i == 1 {
+			expected = 151
+		}
+		v, exists := db.Get(fmt.Sprintf("key%d", i))
+		assert.True(t, exists)
+		assert.Equal(t, expected, v, "key%d", i)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDBBgRewriteAborted(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "abort.aof")
+
+	db, err := Open(path, withFile(func(f *os.File) dbFile {
+		return &faultyFile{f: f, syncDelay: 50 * time.Millisecond}
+	}))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key1", 1))
+	assert.Nil(t, db.Modify("key1", 1))
+
+	done, err := db.BgRewrite()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Equal(t, ErrRewriteAborted, <-done)
+
+	_, err = os.Stat(path + ".rewrite")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	v, _ := db.Get("key1")
+	assert.Equal(t, 2, v)
+	assert.Nil(t, db.Close())
+
+	_, err = db.BgRewrite()
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func waitRewrites(db *DB) DBStats {
+	for {
+		stats := db.Stats()
+		if !stats.Rewriting {
+			return stats
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDBAutoRewrite(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "auto.aof")
+
+	db, err := Open(path, WithSync(SyncNo), WithAutoRewrite(RewritePolicy{GrowthPercent: 100, MinSize: 1024, ObsoleteRatio: 0.5}))
+	assert.Nil(t, err)
+
+	// no line is obsolete, the file only grows
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Create(fmt.Sprintf("key%d", i), i))
+	}
+	stats := waitRewrites(db)
+	assert.Equal(t, 0, stats.Rewrites)
+	assert.Equal(t, 100, stats.Lines)
+	assert.Equal(t, 0, stats.ObsoleteLines)
+	assert.True(t, stats.Size > 1024)
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Modify("key1", 1))
+	}
+	stats = waitRewrites(db)
+	assert.Equal(t, 1, stats.Rewrites)
+	assert.Nil(t, stats.LastRewriteErr)
+	assert.False(t, stats.LastRewrite.IsZero())
+	assert.True(t, stats.LastRewriteTook > 0)
+	assert.True(t, stats.LastRewriteSaved > 0)
+	assert.True(t, stats.BaseSize <= stats.Size)
+	assert.True(t, stats.Lines < 300)
+
+	v, _ := db.Get("key1")
+	assert.Equal(t, 201, v)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(path)
+	assert.Nil(t, err)
+	v, _ = db.Get("key1")
+	assert.Equal(t, 201, v)
+	assert.Equal(t, fileSize(t, path), db.Stats().BaseSize)
+	assert.Nil(t, db.Close())
+}
+
+func TestDBAutoRewriteBackoff(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	now := time.Unix(1000, 0)
+	attempts, failing := 0, true
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+
+	db, err := Open(filepath.Join(dir, "backoff.aof"), WithSync(SyncNo), WithAutoRewrite(RewritePolicy{ObsoleteRatio: 0.5}),
+		withClock(func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}),
+		withFile(func(f *os.File) dbFile {
+			mu.Lock()
+			defer mu.Unlock()
+			if filepath.Ext(f.Name()) != ".rewrite" {
+				return f
+			}
+			// the disk is full
+			attempts++
+			return &faultyFile{f: f, crashed: failing}
+		}))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Create("key", 0))
+
+	update := func(updates, expectedAttempts int) {
+		for i := 0; i < updates; i++ {
+			assert.Nil(t, db.Modify("key", 1))
+			waitRewrites(db)
+		}
+		mu.Lock()
+		assert.Equal(t, expectedAttempts, attempts)
+		mu.Unlock()
+	}
+
+	update(10, 1)
+	assert.Equal(t, errPowerLoss, db.Stats().LastRewriteErr)
+	advance(rewriteRetryDelay)
+	update(10, 2)
+
+	// the delay doubles after every failure in a row
+	advance(rewriteRetryDelay)
+	update(10, 2)
+	advance(rewriteRetryDelay)
+	update(10, 3)
+	advance(3 * rewriteRetryDelay)
+	update(10, 3)
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	advance(rewriteRetryDelay)
+	update(1, 4)
+	stats := db.Stats()
+	assert.Nil(t, stats.LastRewriteErr)
+	assert.Equal(t, 1, stats.Rewrites)
+	assert.Equal(t, 0, db.rewriteFailures)
+
+	v, _ := db.Get("key")
+	assert.Equal(t, 51, v)
+	assert.Nil(t, db.Close())
+}
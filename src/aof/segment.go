@@ -0,0 +1,375 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RotationPolicy tells when a SegmentWriter starts a new segment. A zero limit is not checked.
+type RotationPolicy struct {
+	MaxSize  int64         // bytes of the body lines
+	MaxLines int           // body lines
+	MaxAge   time.Duration // since the first record of the segment
+}
+
+var ErrNoSegments = errors.New("No AOF segments found")
+
+const segmentExt = ".aof"
+
+func segmentName(prefix string, seq int) string {
+	return fmt.Sprintf("%s.%06d%s", prefix, seq, segmentExt)
+}
+
+// segmentSeq returns the sequence number of a segment file name of prefix
+func segmentSeq(prefix, name string) (int, bool) {
+	if len(name) <= len(prefix)+1+len(segmentExt) || !strings.HasPrefix(name, prefix+".") || !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+
+	seq, err := strconv.Atoi(name[len(prefix)+1 : len(name)-len(segmentExt)])
+	return seq, err == nil && seq > 0
+}
+
+// listSegments returns the sequence numbers of the segments of prefix in dir, in order
+func listSegments(dir, prefix string) ([]int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := []int{}
+	for _, info := range infos {
+		if seq, ok := segmentSeq(prefix, info.Name()); ok && info.Mode().IsRegular() {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// SegmentWriter writes an AOF as a series of segment files named
+// <prefix>.<sequence number>.aof. Every segment is a complete AOF with its own
+// header. The records of the current segment go straight to a temporary file,
+// which the rotation turns into the segment; the segment of a writer that
+// stopped before its rotation is completed by the next NewSegmentWriter.
+type SegmentWriter struct {
+	// Checksums adds checksums and a trailer to every segment
+	Checksums bool
+
+	dir     string
+	prefix  string
+	policy  RotationPolicy
+	now     func() time.Time
+	seq     int
+	f       *os.File
+	w       *Writer
+	started time.Time
+	closed  bool
+}
+
+// NewSegmentWriter returns a writer of the segments of prefix in dir. The
+// sequence numbers continue after the segments already in dir.
+func NewSegmentWriter(dir, prefix string, policy RotationPolicy) (*SegmentWriter, error) {
+	seqs, err := listSegments(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sw := &SegmentWriter{dir: dir, prefix: prefix, policy: policy, now: time.Now}
+	if len(seqs) > 0 {
+		sw.seq = seqs[len(seqs)-1]
+	}
+	if err := sw.recover(); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// recover completes the segment of a writer that stopped before its rotation
+func (sw *SegmentWriter) recover() error {
+	// the writer stopped between the rename of the last segment and the removal of its temporary file
+	if sw.seq > 0 {
+		if err := os.Remove(sw.tmpPath(sw.seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	tmp := sw.tmpPath(sw.seq + 1)
+	if _, err := os.Stat(tmp); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	complete, err := completeSegment(tmp, sw.path(sw.seq+1))
+	if err != nil {
+		return err
+	}
+	if complete {
+		sw.seq++
+	}
+	if err := os.Remove(tmp); err != nil {
+		return err
+	}
+	return syncDir(sw.dir)
+}
+
+func (sw *SegmentWriter) Create(key string, value int) error {
+	return sw.write(EventCreate, key, value)
+}
+
+func (sw *SegmentWriter) Set(key string, value int) error {
+	return sw.write(EventSet, key, value)
+}
+
+func (sw *SegmentWriter) Modify(key string, delta int) error {
+	return sw.write(EventModify, key, delta)
+}
+
+func (sw *SegmentWriter) Delete(key string) error {
+	return sw.write(EventDelete, key, 0)
+}
+
+func (sw *SegmentWriter) write(typ EventType, key string, arg int) error {
+	if sw.closed {
+		return ErrWriterClosed
+	}
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	if sw.w != nil && sw.policy.MaxAge > 0 && sw.now().Sub(sw.started) >= sw.policy.MaxAge {
+		if err := sw.Rotate(); err != nil {
+			return err
+		}
+	}
+	if sw.w == nil {
+		if err := sw.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := sw.w.writeEvent(typ, key, arg); err != nil {
+		return err
+	}
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	if (sw.policy.MaxSize > 0 && sw.w.bodySize >= sw.policy.MaxSize) || (sw.policy.MaxLines > 0 && sw.w.lineCount >= sw.policy.MaxLines) {
+		return sw.Rotate()
+	}
+	return nil
+}
+
+func (sw *SegmentWriter) path(seq int) string {
+	return filepath.Join(sw.dir, segmentName(sw.prefix, seq))
+}
+
+func (sw *SegmentWriter) tmpPath(seq int) string {
+	return sw.path(seq) + ".tmp"
+}
+
+func (sw *SegmentWriter) open() error {
+	f, err := os.OpenFile(sw.tmpPath(sw.seq+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	// the footer writer streams the body, it is never closed
+	sw.seq++
+	sw.f = f
+	sw.w = NewFooterWriter(f)
+	sw.w.Checksums = sw.Checksums
+	sw.started = sw.now()
+	return nil
+}
+
+// Rotate completes the current segment, the next record starts a new one. The
+// segment is built from the records in its temporary file, so a failed rotation
+// keeps the segment open and can be retried.
+func (sw *SegmentWriter) Rotate() error {
+	if sw.closed {
+		return ErrWriterClosed
+	}
+	if sw.w == nil {
+		return nil
+	}
+
+	tmp := sw.tmpPath(sw.seq)
+	complete, err := completeSegment(tmp, sw.path(sw.seq))
+	if err != nil {
+		return err
+	}
+	if !complete {
+		// none of the records reached the file
+		sw.seq--
+	}
+
+	sw.f.Close()
+	sw.f, sw.w = nil, nil
+	if err := os.Remove(tmp); err != nil {
+		return err
+	}
+	return syncDir(sw.dir)
+}
+
+// Close completes the current segment. It can be retried when it fails.
+func (sw *SegmentWriter) Close() error {
+	if err := sw.Rotate(); err != nil {
+		return err
+	}
+	sw.closed = true
+	return nil
+}
+
+// cutChecksum returns a body line without the valid checksum it ends with
+func cutChecksum(text string) (string, bool) {
+	i := strings.LastIndex(text, " #")
+	if i < 0 || text[i+1:] != formatChecksum(crc32.Checksum([]byte(text[:i]), castagnoli)) {
+		return text, false
+	}
+	return text[:i], true
+}
+
+// segmentRecord returns the text of a line of a segment body without its
+// checksum, and whether it is a complete valid record
+func segmentRecord(line string, checksums bool) (string, bool) {
+	if !strings.HasSuffix(line, "\n") {
+		return "", false
+	}
+	text, valid := strings.TrimSuffix(line, "\n"), true
+	if checksums {
+		text, valid = cutChecksum(text)
+	}
+	if _, err := parseRecord(text); err != nil {
+		return "", false
+	}
+	return text, valid
+}
+
+// completeSegment writes the body streamed to tmp as the segment at path, with
+// its header and the optional trailer. A line cut off by a crash ends the body.
+// It returns false, and writes no segment, when tmp holds no complete record.
+func completeSegment(tmp, path string) (bool, error) {
+	f, err := os.Open(tmp)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	marker, err := rd.ReadString('\n')
+	if err == io.EOF || (err == nil && marker != footerMarker+"\n") {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// the keys in the order of their first use and their last lines
+	keys := []string{}
+	lastLines := make(map[string]int)
+	lines := 0
+	checksums := false
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if lines == 0 {
+			_, checksums = cutChecksum(strings.TrimSuffix(line, "\n"))
+		}
+		text, ok := segmentRecord(line, checksums)
+		if !ok {
+			break
+		}
+
+		r, _ := parseRecord(text)
+		if _, exists := lastLines[r.key]; !exists {
+			keys = append(keys, r.key)
+		}
+		lastLines[r.key] = lines
+		lines++
+	}
+	if lines == 0 {
+		return false, nil
+	}
+
+	if _, err := f.Seek(int64(len(marker)), io.SeekStart); err != nil {
+		return false, err
+	}
+	rd.Reset(f)
+
+	part := path + ".part"
+	out, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	bw := bufio.NewWriter(out)
+	fmt.Fprintf(bw, "%d\n", len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(bw, "%s %d\n", key, lastLines[key])
+	}
+	var rolling uint32
+	for i := 0; i < lines; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			out.Close()
+			return false, err
+		}
+		bw.WriteString(line)
+		if checksums {
+			text, _ := segmentRecord(line, true)
+			rolling = crc32.Update(rolling, castagnoli, []byte(text+"\n"))
+		}
+	}
+	if checksums {
+		fmt.Fprintf(bw, "%s %d %s\n", trailerRecord, lines, formatChecksum(rolling))
+	}
+
+	err = bw.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part, path)
+	}
+	if err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	return true, nil
+}
+
+// OpenSegments returns a parser that replays the segments of prefix in dir as one
+// AOF, in the order of their sequence numbers. The sequence must not have gaps.
+func OpenSegments(dir, prefix string) (*AOFParser, error) {
+	seqs, err := listSegments(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		return nil, ErrNoSegments
+	}
+
+	files := []string{}
+	for i, seq := range seqs {
+		if i > 0 && seq != seqs[i-1]+1 {
+			return nil, fmt.Errorf("Missing segment: %s", segmentName(prefix, seqs[i-1]+1))
+		}
+		files = append(files, filepath.Join(dir, segmentName(prefix, seq)))
+	}
+	return newFilesParser(files)
+}
@@ -0,0 +1,166 @@
+package aof
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+
+	files := make(map[string]string)
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		assert.Nil(t, err)
+		files[info.Name()] = string(data)
+	}
+	return files
+}
+
+func TestSegmentWriter(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	sw, err := NewSegmentWriter(dir, "log", RotationPolicy{MaxLines: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, sw.Create("key1", 1))
+	assert.Nil(t, sw.Create("key2", 2))
+	assert.Nil(t, sw.Modify("key1", 1))
+	assert.Nil(t, sw.Set("key2", 5))
+	assert.Equal(t, ErrInvalidKey, sw.Delete("key 1"))
+	assert.Equal(t, map[string]string{
+		"log.000001.aof":     "2\nkey1 2\nkey2 1\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +1\n",
+		"log.000002.aof.tmp": "FOOTER\nSET key2 5\n", // the records of the open segment are on the disk
+	}, readFiles(t, dir))
+
+	assert.Nil(t, sw.Rotate())
+	assert.Nil(t, sw.Rotate())
+	assert.Nil(t, sw.Close())
+	assert.Equal(t, ErrWriterClosed, sw.Create("key3", 3))
+	assert.Equal(t, map[string]string{
+		"log.000001.aof": "2\nkey1 2\nkey2 1\nCREATE key1 1\nCREATE key2 2\nMODIFY key1 +1\n",
+		"log.000002.aof": "1\nkey2 0\nSET key2 5\n",
+	}, readFiles(t, dir))
+
+	// a new writer continues the sequence
+	now := time.Now()
+	sw, err = NewSegmentWriter(dir, "log", RotationPolicy{MaxSize: 30, MaxAge: time.Hour})
+	assert.Nil(t, err)
+	sw.Checksums = true
+	sw.now = func() time.Time { return now }
+	assert.Nil(t, sw.Delete("key2"))
+	now = now.Add(time.Hour)
+	assert.Nil(t, sw.Modify("key1", 10))
+	assert.Nil(t, sw.Create("key3", 3))
+	assert.Nil(t, sw.Create("key4", 4))
+	assert.Nil(t, sw.Modify("key4", 4))
+	assert.Nil(t, sw.Close())
+
+	files := readFiles(t, dir)
+	assert.Equal(t, 5, len(files))
+	assert.Equal(t, "1\nkey2 0\nDELETE key2 #81025161\nTRAILER 1 #aab36959\n", files["log.000003.aof"])
+	assert.Equal(t, "2\nkey1 0\nkey3 1\nMODIFY key1 +10 #63b91290\nCREATE key3 3 #3d08637a\nTRAILER 2 #e40896d0\n", files["log.000004.aof"])
+
+	p, err := OpenSegments(dir, "log")
+	assert.Nil(t, err)
+	states, err := readStates(p)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "key2", Value: 5, Deleted: true, FirstLine: 1, LastLine: 4, UpdateCount: 3},
+		{Key: "key1", Value: 12, FirstLine: 0, LastLine: 5, UpdateCount: 3},
+		{Key: "key3", Value: 3, FirstLine: 6, LastLine: 6, UpdateCount: 1},
+		{Key: "key4", Value: 8, FirstLine: 7, LastLine: 8, UpdateCount: 2},
+	}, states)
+
+	_, err = OpenSegments(dir, "other")
+	assert.Equal(t, ErrNoSegments, err)
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "log.000002.aof")))
+	_, err = OpenSegments(dir, "log")
+	assert.EqualError(t, err, "Missing segment: log.000002.aof")
+}
+
+func TestSegmentWriterCrash(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		dir, cleanup := tempDir(t)
+
+		sw, err := NewSegmentWriter(dir, "log", RotationPolicy{MaxLines: 2})
+		assert.Nil(t, err)
+		sw.Checksums = checksums
+		assert.Nil(t, sw.Create("key1", 1))
+		assert.Nil(t, sw.Create("key2", 2))
+		assert.Nil(t, sw.Modify("key1", 1))
+		assert.Nil(t, sw.Delete("key2"))
+		assert.Nil(t, sw.Create("key3", 3))
+
+		// the writer is killed in the middle of a record of the third segment
+		sw.f.WriteString("CREATE key4")
+		sw.f.Close()
+
+		var expected bytes.Buffer
+		w := NewWriter(&expected)
+		w.Checksums = checksums
+		w.Create("key3", 3)
+		w.Close()
+
+		sw, err = NewSegmentWriter(dir, "log", RotationPolicy{})
+		assert.Nil(t, err)
+		files := readFiles(t, dir)
+		assert.Equal(t, 3, len(files))
+		assert.Equal(t, expected.String(), files["log.000003.aof"])
+
+		assert.Nil(t, sw.Set("key3", 5))
+		assert.Nil(t, sw.Close())
+		p, err := OpenSegments(dir, "log")
+		assert.Nil(t, err)
+		states, err := readStates(p)
+		assert.Nil(t, err)
+		assert.Equal(t, []KeyState{
+			{Key: "key1", Value: 2, FirstLine: 0, LastLine: 2, UpdateCount: 2},
+			{Key: "key2", Value: 2, Deleted: true, FirstLine: 1, LastLine: 3, UpdateCount: 2},
+			{Key: "key3", Value: 5, FirstLine: 4, LastLine: 5, UpdateCount: 2},
+		}, states)
+
+		// killed before a record reached the file, or after the rename of a segment
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "log.000005.aof.tmp"), []byte("FOOTER\nCRE"), 0644))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "log.000004.aof.tmp"), []byte("FOOTER\nSET key3 5\n"), 0644))
+		sw, err = NewSegmentWriter(dir, "log", RotationPolicy{})
+		assert.Nil(t, err)
+		assert.Equal(t, 4, sw.seq)
+		assert.Equal(t, 4, len(readFiles(t, dir)))
+		assert.Nil(t, sw.Close())
+
+		cleanup()
+	}
+}
+
+func TestSegmentWriterRotateFailure(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	sw, err := NewSegmentWriter(dir, "log", RotationPolicy{})
+	assert.Nil(t, err)
+	assert.Nil(t, sw.Create("key1", 1))
+
+	// the segment cannot replace a directory
+	blocker := filepath.Join(dir, "log.000001.aof")
+	assert.Nil(t, os.Mkdir(blocker, 0755))
+	assert.NotNil(t, sw.Rotate())
+	assert.NotNil(t, sw.Close())
+	assert.Equal(t, 1, sw.seq)
+
+	// the segment stays open
+	assert.Nil(t, sw.Modify("key1", 2))
+	assert.Nil(t, os.Remove(blocker))
+	assert.Nil(t, sw.Close())
+	assert.Equal(t, map[string]string{
+		"log.000001.aof": "1\nkey1 1\nCREATE key1 1\nMODIFY key1 +2\n",
+	}, readFiles(t, dir))
+}
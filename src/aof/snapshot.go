@@ -0,0 +1,175 @@
+package aof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A mixed AOF starts with a binary snapshot of the live keys, followed by a
+// text tail that is a normal AOF whose body may update the keys of the
+// snapshot without creating them. The snapshot is:
+//
+//	magic "AOFSNAP\x01"
+//	payload size, 8 bytes big endian
+//	payload: uvarint number of keys, then for every key a uvarint key size, the key and a varint value
+//	CRC32C of the payload, 4 bytes big endian
+//
+// The footer offset of a footer-indexed tail counts from the start of the tail.
+const snapshotMagic = "AOFSNAP\x01"
+
+var ErrSnapshotCorrupt = errors.New("Snapshot is corrupt")
+
+// WriteBinarySnapshot writes the snapshot that starts a mixed AOF, with the keys
+// in their order. The tail is written to w after it.
+func WriteBinarySnapshot(w io.Writer, keys []string, values map[string]int) error {
+	payload := []byte{}
+	buf := make([]byte, binary.MaxVarintLen64)
+	payload = append(payload, buf[:binary.PutUvarint(buf, uint64(len(keys)))]...)
+	for _, key := range keys {
+		if !validKey(key) {
+			return ErrInvalidKey
+		}
+		payload = append(payload, buf[:binary.PutUvarint(buf, uint64(len(key)))]...)
+		payload = append(payload, key...)
+		payload = append(payload, buf[:binary.PutVarint(buf, int64(values[key]))]...)
+	}
+
+	header := make([]byte, len(snapshotMagic)+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic):], uint64(len(payload)))
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(payload, castagnoli))
+
+	for _, b := range [][]byte{header, payload, sum} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshot loads the snapshot a mixed AOF starts with into the values. A
+// seekable input is read directly, so it is left at the start of the tail
+// before its footer is read; other inputs are read through the lexer.
+func (p *AOFParser) readSnapshot() error {
+	if rs, ok := p.rd.(io.ReadSeeker); ok {
+		if base, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			magic := make([]byte, len(snapshotMagic))
+			if n, _ := io.ReadFull(rs, magic); n < len(magic) || string(magic) != snapshotMagic {
+				_, err := rs.Seek(base, io.SeekStart)
+				return err
+			}
+			return p.loadSnapshot(rs)
+		}
+	}
+
+	if magic, _ := p.lex.rd.Peek(len(snapshotMagic)); string(magic) != snapshotMagic {
+		return nil
+	}
+	p.lex.rd.Discard(len(snapshotMagic))
+	return p.loadSnapshot(p.lex.rd)
+}
+
+// loadSnapshot reads the snapshot after its magic without reading past its end
+func (p *AOFParser) loadSnapshot(rd io.Reader) error {
+	var size uint64
+	if err := binary.Read(rd, binary.BigEndian, &size); err != nil {
+		return ErrSnapshotCorrupt
+	}
+
+	h := crc32.New(castagnoli)
+	payload := bufio.NewReader(io.TeeReader(io.LimitReader(rd, int64(size)), h))
+	count, err := binary.ReadUvarint(payload)
+	if err != nil {
+		return ErrSnapshotCorrupt
+	}
+
+	keys := []string{}
+	snapshot := make(map[string]int)
+	for i := uint64(0); i < count; i++ {
+		n, err := binary.ReadUvarint(payload)
+		if err != nil || n > size {
+			return ErrSnapshotCorrupt
+		}
+		key := make([]byte, n)
+		if _, err := io.ReadFull(payload, key); err != nil || !validKey(string(key)) {
+			return ErrSnapshotCorrupt
+		}
+		val, err := binary.ReadVarint(payload)
+		if err != nil {
+			return ErrSnapshotCorrupt
+		}
+		if _, exists := snapshot[string(key)]; !exists {
+			keys = append(keys, string(key))
+		}
+		snapshot[string(key)] = int(val)
+	}
+
+	var sum uint32
+	if _, err := payload.ReadByte(); err != io.EOF {
+		return ErrSnapshotCorrupt
+	}
+	if err := binary.Read(rd, binary.BigEndian, &sum); err != nil || sum != h.Sum32() {
+		return ErrSnapshotCorrupt
+	}
+	p.snapshotKeys, p.snapshot = keys, snapshot
+	for _, key := range keys {
+		if err := p.putValue(key, value{val: snapshot[key]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UntouchedSnapshot returns the keys of the binary snapshot of a mixed AOF that
+// its tail does not use, in their order, with their values. It is called once
+// a body event or the end of the replay is received.
+func (p *AOFParser) UntouchedSnapshot() ([]string, map[string]int) {
+	return append([]string{}, p.untouchedKeys()...), p.snapshot
+}
+
+func (p *AOFParser) untouchedKeys() []string {
+	if !p.headerSent {
+		// a tail without a header uses no key
+		return p.snapshotKeys
+	}
+	return p.untouched
+}
+
+// EmitUntouched passes the keys of the binary snapshot of a mixed AOF that its
+// tail does not use to fn, in their order, with their values. Like
+// UntouchedSnapshot, it is called once a body event or the end of the replay
+// is received; the keys come before the ones of the tail.
+func (p *AOFParser) EmitUntouched(fn func(key string, value int) error) error {
+	for _, key := range p.untouchedKeys() {
+		if err := fn(key, p.snapshot[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactSnapshot replays the AOF read from rd and writes its final state to w
+// as a mixed AOF: a binary snapshot of the live keys and an empty text tail.
+func CompactSnapshot(w io.Writer, rd io.Reader) error {
+	states, err := ReadState(rd)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	values := make(map[string]int)
+	for _, s := range states {
+		if !s.Deleted {
+			keys = append(keys, s.Key)
+			values[s.Key] = s.Value
+		}
+	}
+	if err := WriteBinarySnapshot(w, keys, values); err != nil {
+		return err
+	}
+	return NewWriter(w).Close()
+}
@@ -0,0 +1,74 @@
+package aof
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mixedAOF returns a mixed AOF with the snapshot k=10, j=1 and the text tail
+func mixedAOF(tail string) string {
+	var mixed bytes.Buffer
+	WriteBinarySnapshot(&mixed, []string{"k", "j"}, map[string]int{"k": 10, "j": 1})
+	mixed.WriteString(tail)
+	return mixed.String()
+}
+
+func TestMixedAOF(t *testing.T) {
+	var mixed bytes.Buffer
+	assert.Nil(t, WriteBinarySnapshot(&mixed, []string{"a", "b", "c"}, map[string]int{"a": 1, "b": -2, "c": 300}))
+	mixed.WriteString("2\nb 0\nd 1\nMODIFY b +5\nCREATE d 4\n")
+
+	// seekable and streamed inputs
+	for _, rd := range []io.Reader{bytes.NewReader(mixed.Bytes()), struct{ io.Reader }{bytes.NewReader(mixed.Bytes())}} {
+		var out bytes.Buffer
+		w := NewWriter(&out)
+		assert.Nil(t, Compact(w, rd))
+		assert.Nil(t, w.Close())
+		assert.Equal(t, "4\na 0\nc 1\nb 2\nd 3\nCREATE a 1\nCREATE c 300\nCREATE b 3\nCREATE d 4\n", out.String())
+	}
+
+	// a footer-indexed tail
+	var footer bytes.Buffer
+	assert.Nil(t, WriteBinarySnapshot(&footer, []string{"a", "b"}, map[string]int{"a": 1, "b": 2}))
+	fw := NewFooterWriter(&footer)
+	fw.Delete("a")
+	fw.Set("b", 9)
+	fw.Create("a", 5)
+	assert.Nil(t, fw.Close())
+	states, err := ReadState(bytes.NewReader(footer.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "b", Value: 9, FirstLine: 1, LastLine: 1, UpdateCount: 1},
+		{Key: "a", Value: 5, FirstLine: 0, LastLine: 2, UpdateCount: 2},
+	}, states)
+
+	// the compactor writes the mixed format
+	var compacted bytes.Buffer
+	assert.Nil(t, CompactSnapshot(&compacted, bytes.NewReader(mixed.Bytes())))
+	assert.True(t, strings.HasSuffix(compacted.String(), "0\n"))
+	states, err = ReadState(bytes.NewReader(compacted.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "a", Value: 1, FirstLine: -1, LastLine: -1},
+		{Key: "c", Value: 300, FirstLine: -1, LastLine: -1},
+		{Key: "b", Value: 3, FirstLine: -1, LastLine: -1},
+		{Key: "d", Value: 4, FirstLine: -1, LastLine: -1},
+	}, states)
+
+	// the tail cannot create a key of the snapshot again
+	data := mixed.String()
+	data = strings.Replace(data, "MODIFY b +5", "CREATE b 5", 1)
+	_, err = ReadState(strings.NewReader(data))
+	assert.EqualError(t, err, "ERROR at line 4: Key 'b' has already been created")
+
+	corrupt := mixed.Bytes()
+	corrupt[len(snapshotMagic)+9] ^= 1
+	_, err = ReadState(bytes.NewReader(corrupt))
+	assert.EqualError(t, err, "ERROR at line 1: Snapshot is corrupt")
+
+	assert.Equal(t, ErrInvalidKey, WriteBinarySnapshot(&mixed, []string{"a b"}, nil))
+}
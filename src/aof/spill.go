@@ -0,0 +1,414 @@
+package aof
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SpillOptions bound the memory of SpillCompact. The keys of the header and of
+// a binary snapshot stay in memory for the whole compaction and count against
+// MemoryLimit; the records get what is left of it, at worst they are spilled
+// one by one.
+type SpillOptions struct {
+	Dir         string // of the run files, the default temporary directory when empty
+	MemoryLimit int64  // bytes of keys and records kept in memory before the records are spilled to a run file
+}
+
+var DefaultSpillOptions = SpillOptions{MemoryLimit: 256 << 20}
+
+var ErrSpillNoHeader = errors.New("Spill compaction needs the header or the footer index of the AOF")
+
+// spillFanIn is the number of run files that are merged at once
+const spillFanIn = 64
+
+// spillRecord is a body line, or the final value of a live key
+type spillRecord struct {
+	key   string
+	line  int
+	typ   EventType
+	arg   int
+	final bool
+}
+
+// keySize approximates the memory a key takes in a map or a sorter
+func keySize(key string) int64 {
+	return int64(len(key)) + 64
+}
+
+// size approximates the memory a record takes in a sorter
+func (r *spillRecord) size() int64 {
+	return keySize(r.key)
+}
+
+// spillLimit returns what is left of limit once used bytes are taken, at least 1
+func spillLimit(limit, used int64) int64 {
+	if limit-used < 1 {
+		return 1
+	}
+	return limit - used
+}
+
+func byKeyLine(a, b *spillRecord) bool {
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.line < b.line
+}
+
+func byRecordLine(a, b *spillRecord) bool {
+	return a.line < b.line
+}
+
+type recordSort struct {
+	records []spillRecord
+	less    func(a, b *spillRecord) bool
+}
+
+func (s recordSort) Len() int           { return len(s.records) }
+func (s recordSort) Swap(i, j int)      { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s recordSort) Less(i, j int) bool { return s.less(&s.records[i], &s.records[j]) }
+
+func writeSpillRecord(w *bufio.Writer, r *spillRecord) error {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+len(r.key))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(r.key)))]...)
+	buf = append(buf, r.key...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(r.line))]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(r.typ))]...)
+	buf = append(buf, tmp[:binary.PutVarint(tmp, int64(r.arg))]...)
+	if r.final {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readSpillRecord returns io.EOF after the last record of a run file
+func readSpillRecord(rd *bufio.Reader) (spillRecord, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return spillRecord{}, err
+	}
+	key := make([]byte, n)
+	if _, err := io.ReadFull(rd, key); err != nil {
+		return spillRecord{}, io.ErrUnexpectedEOF
+	}
+	line, err1 := binary.ReadUvarint(rd)
+	typ, err2 := binary.ReadUvarint(rd)
+	arg, err3 := binary.ReadVarint(rd)
+	final, err4 := rd.ReadByte()
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return spillRecord{}, io.ErrUnexpectedEOF
+	}
+	return spillRecord{key: string(key), line: int(line), typ: EventType(typ), arg: int(arg), final: final == 1}, nil
+}
+
+// spillSorter sorts records that may not fit in memory. The records are sorted
+// in memory up to the limit, then written to a sorted run file; the run files
+// are merged when the records are read back.
+type spillSorter struct {
+	dir     string
+	name    string
+	limit   int64
+	less    func(a, b *spillRecord) bool
+	records []spillRecord
+	size    int64
+	runs    []string
+	spilled int // run files written, merged ones included
+}
+
+func newSpillSorter(dir, name string, limit int64, less func(a, b *spillRecord) bool) *spillSorter {
+	return &spillSorter{dir: dir, name: name, limit: limit, less: less}
+}
+
+func (s *spillSorter) add(r spillRecord) error {
+	s.records = append(s.records, r)
+	s.size += r.size()
+	if s.size >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *spillSorter) newRun() (*os.File, error) {
+	s.spilled++
+	return os.Create(filepath.Join(s.dir, fmt.Sprintf("%s-%06d.run", s.name, s.spilled)))
+}
+
+// spill writes the records in memory to a sorted run file
+func (s *spillSorter) spill() error {
+	sort.Sort(recordSort{s.records, s.less})
+	f, err := s.newRun()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for i := range s.records {
+		if err = writeSpillRecord(bw, &s.records[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	s.runs = append(s.runs, f.Name())
+	s.records, s.size = nil, 0
+	return err
+}
+
+type runCursor struct {
+	r  spillRecord
+	rd *bufio.Reader
+	f  *os.File
+}
+
+type runHeap struct {
+	cursors []*runCursor
+	less    func(a, b *spillRecord) bool
+}
+
+func (h *runHeap) Len() int           { return len(h.cursors) }
+func (h *runHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *runHeap) Less(i, j int) bool { return h.less(&h.cursors[i].r, &h.cursors[j].r) }
+func (h *runHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*runCursor)) }
+func (h *runHeap) Pop() (x interface{}) {
+	n := len(h.cursors)
+	x, h.cursors = h.cursors[n-1], h.cursors[:n-1]
+	return x
+}
+
+// merge passes the records of the run files to fn in order
+func (s *spillSorter) merge(runs []string, fn func(r spillRecord) error) error {
+	h := &runHeap{less: s.less}
+	defer func() {
+		for _, c := range h.cursors {
+			c.f.Close()
+		}
+	}()
+
+	for _, run := range runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		c := &runCursor{rd: bufio.NewReader(f), f: f}
+		if c.r, err = readSpillRecord(c.rd); err == io.EOF {
+			f.Close()
+			continue
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		h.cursors = append(h.cursors, c)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		c := h.cursors[0]
+		if err := fn(c.r); err != nil {
+			return err
+		}
+
+		var err error
+		if c.r, err = readSpillRecord(c.rd); err == io.EOF {
+			heap.Pop(h)
+			c.f.Close()
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// each passes all the records to fn in order. The records that fit in memory
+// are not spilled; it can be called again.
+func (s *spillSorter) each(fn func(r spillRecord) error) error {
+	if len(s.runs) == 0 {
+		sort.Sort(recordSort{s.records, s.less})
+		for _, r := range s.records {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(s.records) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	// too many run files are merged into bigger ones first
+	for len(s.runs) > spillFanIn {
+		runs := []string{}
+		for i := 0; i < len(s.runs); i += spillFanIn {
+			end := i + spillFanIn
+			if end > len(s.runs) {
+				end = len(s.runs)
+			}
+
+			f, err := s.newRun()
+			if err != nil {
+				return err
+			}
+			bw := bufio.NewWriter(f)
+			err = s.merge(s.runs[i:end], func(r spillRecord) error {
+				return writeSpillRecord(bw, &r)
+			})
+			if err == nil {
+				err = bw.Flush()
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			for _, run := range s.runs[i:end] {
+				os.Remove(run)
+			}
+			runs = append(runs, f.Name())
+		}
+		s.runs = runs
+	}
+
+	return s.merge(s.runs, fn)
+}
+
+// SpillCompact writes the same AOF as Compact to w, keeping the memory the
+// key states take under opts.MemoryLimit. The body records are sorted by key
+// and line in run files, merged to replay every key on its own, and the final
+// values are sorted back by line. The keys of the header and of the snapshot
+// are still held in memory: they count against the limit, but a header bigger
+// than the limit goes over it. An AOF without a header or a footer index is
+// out of scope, like for Compact, and returns ErrSpillNoHeader. w must be a
+// new header writer, the caller closes it.
+func SpillCompact(w *Writer, rd io.Reader, opts SpillOptions) error {
+	_, err := spillCompact(w, rd, opts)
+	return err
+}
+
+// spillCompact returns the number of run files it wrote
+func spillCompact(w *Writer, rd io.Reader, opts SpillOptions) (int, error) {
+	if opts.MemoryLimit <= 0 {
+		opts.MemoryLimit = DefaultSpillOptions.MemoryLimit
+	}
+	if w.footer || w.lineCount > 0 {
+		return 0, ErrWriterNotEmpty
+	}
+
+	dir, err := ioutil.TempDir(opts.Dir, "aofspill")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	// the records are sorted by key and line as they are parsed
+	p := NewAOFParser(rd)
+	p.raw = true
+	go p.Parse()
+	defer p.Quit()
+
+	lines := newSpillSorter(dir, "lines", opts.MemoryLimit, byKeyLine)
+	headerLines, headerSize := 0, int64(0)
+	var parseErr error
+	for parseErr == nil {
+		event := p.NextEvent()
+		switch event.Type {
+		case EventError:
+			parseErr = p.Error()
+			if p.noHeader {
+				parseErr = ErrSpillNoHeader
+			}
+		case EventHeader:
+			headerLines = p.curHeaderLine
+			headerSize = p.headerSize
+			lines.limit = spillLimit(opts.MemoryLimit, headerSize)
+		case EventQuit, EventCompleted:
+			parseErr = io.EOF
+		default:
+			r := spillRecord{key: event.Key, line: event.Line, typ: event.Type & ^EventFinal, arg: event.Value, final: event.Type&EventFinal == EventFinal}
+			if err := lines.add(r); err != nil {
+				return lines.spilled, err
+			}
+		}
+	}
+	if parseErr == io.EOF {
+		parseErr = nil
+	}
+
+	// every key is replayed from its own records, the first error in the
+	// file wins like in a sequential replay
+	snapshot := p.snapshot
+	// the records that were not spilled stay in memory next to the finals
+	finals := newSpillSorter(dir, "finals", spillLimit(opts.MemoryLimit, headerSize+lines.size), byRecordLine)
+	var stateErr *ParseError
+	count := len(p.untouchedKeys())
+	key, v, exists, failed, last := "", value{}, false, false, spillRecord{}
+	flush := func() error {
+		if key == "" || failed || !last.final || v.deleted {
+			return nil
+		}
+		count++
+		return finals.add(spillRecord{key: key, line: last.line, typ: EventCreate, arg: v.val})
+	}
+	err = lines.each(func(r spillRecord) error {
+		if r.key != key {
+			if err := flush(); err != nil {
+				return err
+			}
+			val, inSnapshot := snapshot[r.key]
+			key, v, exists, failed = r.key, value{val: val}, inSnapshot, false
+		}
+		if failed {
+			return nil
+		}
+
+		var err error
+		if v, err = applyEvent(r.typ, r.key, r.arg, v, exists); err != nil {
+			failed = true
+			if line := headerLines + r.line + 1; stateErr == nil || line < stateErr.Line {
+				stateErr = &ParseError{Line: line, Msg: err.Error()}
+			}
+		}
+		exists, last = true, r
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if pe, ok := parseErr.(*ParseError); err == nil && stateErr != nil && (parseErr == nil || (ok && stateErr.Line < pe.Line)) {
+		err = stateErr
+	} else if err == nil {
+		err = parseErr
+	}
+	if err != nil {
+		return lines.spilled + finals.spilled, err
+	}
+
+	err = w.streamCompacted(count, func(fn func(key string, value int) error) error {
+		if err := p.EmitUntouched(fn); err != nil {
+			return err
+		}
+		return finals.each(func(r spillRecord) error {
+			return fn(r.key, r.arg)
+		})
+	})
+	return lines.spilled + finals.spilled, err
+}
@@ -0,0 +1,94 @@
+package aof
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// spillChecked checks spillCompact against Compact and returns the number of run files of the last input
+func spillChecked(t *testing.T, inputs [][]byte, opts SpillOptions) int {
+	runs := 0
+	checkCompactor(t, inputs, func(w *Writer, rd io.Reader) error {
+		var err error
+		runs, err = spillCompact(w, rd, opts)
+		return err
+	})
+	return runs
+}
+
+func TestSpillCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spilltest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rnd := rand.New(rand.NewSource(2))
+	for _, footer := range []bool{false, true} {
+		data := [][]byte{randomAOF(rnd, footer, false, 2000)}
+
+		// a run file for every record, merged in several passes
+		runs := spillChecked(t, data, SpillOptions{Dir: dir, MemoryLimit: 1})
+		assert.True(t, runs > 2000, "runs=%d", runs)
+
+		runs = spillChecked(t, data, SpillOptions{Dir: dir, MemoryLimit: 16384})
+		assert.True(t, runs > 1 && runs < spillFanIn, "runs=%d", runs)
+
+		assert.Equal(t, 0, spillChecked(t, data, SpillOptions{Dir: dir}))
+	}
+
+	// the edge cases spill every record, the bigger inputs a few run files
+	for _, data := range compactCorpus(rnd) {
+		opts := SpillOptions{Dir: dir, MemoryLimit: 1}
+		if len(data) > 1024 {
+			opts.MemoryLimit = 16384
+		}
+		spillChecked(t, [][]byte{data}, opts)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpillCompactHeaderBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spilltest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the header takes as much memory as the records
+	var data bytes.Buffer
+	w := NewWriter(&data)
+	headerSize := int64(0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		w.Create(key, i)
+		headerSize += keySize(key)
+	}
+	assert.Nil(t, w.Close())
+
+	// the records alone would fit
+	runs := spillChecked(t, [][]byte{data.Bytes()}, SpillOptions{Dir: dir, MemoryLimit: headerSize * 3 / 2})
+	assert.True(t, runs > 0, "runs=%d", runs)
+	assert.Equal(t, 0, spillChecked(t, [][]byte{data.Bytes()}, SpillOptions{Dir: dir, MemoryLimit: headerSize * 4}))
+
+	// a header bigger than the limit spills every record
+	runs = spillChecked(t, [][]byte{data.Bytes()}, SpillOptions{Dir: dir, MemoryLimit: headerSize / 2})
+	assert.True(t, runs >= 1000, "runs=%d", runs)
+}
+
+func TestSpillCompactWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Create("a", 1)
+	assert.Equal(t, ErrWriterNotEmpty, SpillCompact(w, strings.NewReader("0\n"), DefaultSpillOptions))
+	assert.Equal(t, ErrWriterNotEmpty, SpillCompact(NewFooterWriter(&buf), strings.NewReader("0\n"), DefaultSpillOptions))
+	assert.Equal(t, ErrSpillNoHeader, SpillCompact(NewWriter(&buf), strings.NewReader("CREATE a 1\nCREATE b 2\n"), DefaultSpillOptions))
+	assert.EqualError(t, SpillCompact(NewWriter(&buf), strings.NewReader("1\na x\n"), DefaultSpillOptions), "ERROR at line 2: Unexpected token: tokenString, expected tokenNumber")
+}
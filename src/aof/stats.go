@@ -0,0 +1,228 @@
+package aof
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/tabwriter"
+)
+
+type StatsFormat int
+
+const (
+	StatsTable StatsFormat = iota
+	StatsJSON
+)
+
+func ParseStatsFormat(s string) (StatsFormat, error) {
+	switch s {
+	case "table":
+		return StatsTable, nil
+	case "json":
+		return StatsJSON, nil
+	}
+	return StatsTable, fmt.Errorf("Unknown stats format: %s", s)
+}
+
+// KeyStats counts the body lines of one key. More than one CREATE means the
+// key was deleted and created again.
+type KeyStats struct {
+	Key     string
+	Lines   int
+	Creates int
+	Deletes int
+}
+
+// AOFStats describes the body of an AOF
+type AOFStats struct {
+	Lines         int
+	Creates       int
+	Sets          int
+	Modifies      int
+	Deletes       int
+	Keys          int // distinct keys, with the snapshot keys of a mixed AOF that the tail does not use
+	DeletedKeys   int // keys that end deleted
+	RecreatedKeys int // keys created more than once
+	ObsoleteLines int // body lines that are not the last line of a live key
+	CompactedSize int64
+	KeyStats      []KeyStats // the hottest keys first
+}
+
+// ObsoleteRatio returns the share of the body lines that compaction drops
+func (s *AOFStats) ObsoleteRatio() float64 {
+	if s.Lines == 0 {
+		return 0
+	}
+	return float64(s.ObsoleteLines) / float64(s.Lines)
+}
+
+type byLines []KeyStats
+
+func (s byLines) Len() int      { return len(s) }
+func (s byLines) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLines) Less(i, j int) bool {
+	if s[i].Lines != s[j].Lines {
+		return s[i].Lines > s[j].Lines
+	}
+	return s[i].Key < s[j].Key
+}
+
+// ReadStats replays the AOF read from rd and counts its body lines. CompactedSize
+// is the size of the AOF that Compact writes for it, without checksums, so it
+// includes the snapshot keys of a mixed AOF.
+func ReadStats(rd io.Reader) (*AOFStats, error) {
+	s := &AOFStats{KeyStats: []KeyStats{}}
+	index := make(map[string]int)
+	compacted := NewWriter(ioutil.Discard)
+	p := NewAOFParser(rd)
+
+	// the keys of a snapshot that the tail does not use are compacted first, like Compact does
+	untouched := -1
+	writeSnapshot := func() error {
+		if untouched >= 0 {
+			return nil
+		}
+		untouched = len(p.untouchedKeys())
+		return p.EmitUntouched(compacted.Create)
+	}
+
+	err := replay(p, func(event Event) error {
+		if err := writeSnapshot(); err != nil {
+			return err
+		}
+		i, exists := index[event.Key]
+		if !exists {
+			i = len(s.KeyStats)
+			index[event.Key] = i
+			s.KeyStats = append(s.KeyStats, KeyStats{Key: event.Key})
+		}
+		k := &s.KeyStats[i]
+		k.Lines++
+		s.Lines++
+
+		switch event.Type & ^EventFinal {
+		case EventCreate:
+			k.Creates++
+			s.Creates++
+		case EventSet:
+			s.Sets++
+		case EventModify:
+			s.Modifies++
+		case EventDelete:
+			k.Deletes++
+			s.Deletes++
+		}
+
+		if event.Type&EventFinal == EventFinal {
+			if event.Deleted {
+				s.DeletedKeys++
+			} else {
+				return compacted.Create(event.Key, event.Value)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = writeSnapshot()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := compacted.Close(); err != nil {
+		return nil, err
+	}
+
+	s.Keys = len(s.KeyStats) + untouched
+	s.ObsoleteLines = s.Lines - (len(compacted.keys) - untouched)
+	s.CompactedSize = compacted.offset
+	for _, k := range s.KeyStats {
+		if k.Creates > 1 {
+			s.RecreatedKeys++
+		}
+	}
+	sort.Sort(byLines(s.KeyStats))
+	return s, nil
+}
+
+// Write writes the statistics with the top hottest keys, all of them when top is 0
+func (s *AOFStats) Write(w io.Writer, format StatsFormat, top int) error {
+	keys := s.KeyStats
+	if top > 0 && top < len(keys) {
+		keys = keys[:top]
+	}
+
+	switch format {
+	case StatsTable:
+		return s.writeTable(w, keys)
+	case StatsJSON:
+		return s.writeJSON(w, keys)
+	}
+	return fmt.Errorf("Unknown stats format: %d", format)
+}
+
+func (s *AOFStats) writeTable(w io.Writer, keys []KeyStats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "lines\t%d\n", s.Lines)
+	fmt.Fprintf(tw, "creates\t%d\n", s.Creates)
+	fmt.Fprintf(tw, "sets\t%d\n", s.Sets)
+	fmt.Fprintf(tw, "modifies\t%d\n", s.Modifies)
+	fmt.Fprintf(tw, "deletes\t%d\n", s.Deletes)
+	fmt.Fprintf(tw, "keys\t%d\n", s.Keys)
+	fmt.Fprintf(tw, "deleted keys\t%d\n", s.DeletedKeys)
+	fmt.Fprintf(tw, "recreated keys\t%d\n", s.RecreatedKeys)
+	fmt.Fprintf(tw, "obsolete lines\t%d (%.1f%%)\n", s.ObsoleteLines, s.ObsoleteRatio()*100)
+	fmt.Fprintf(tw, "compacted size\t%d bytes\n", s.CompactedSize)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "key\tlines\tcreates\tdeletes\n")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", k.Key, k.Lines, k.Creates, k.Deletes)
+	}
+	return tw.Flush()
+}
+
+type jsonKeyStats struct {
+	Key     string `json:"key"`
+	Lines   int    `json:"lines"`
+	Creates int    `json:"creates"`
+	Deletes int    `json:"deletes"`
+}
+
+type jsonStats struct {
+	Lines         int            `json:"lines"`
+	Actions       map[string]int `json:"actions"`
+	Keys          int            `json:"keys"`
+	DeletedKeys   int            `json:"deleted_keys"`
+	RecreatedKeys int            `json:"recreated_keys"`
+	ObsoleteLines int            `json:"obsolete_lines"`
+	ObsoleteRatio float64        `json:"obsolete_ratio"`
+	CompactedSize int64          `json:"compacted_size"`
+	Hottest       []jsonKeyStats `json:"hottest"`
+}
+
+func (s *AOFStats) writeJSON(w io.Writer, keys []KeyStats) error {
+	js := jsonStats{
+		Lines:         s.Lines,
+		Actions:       map[string]int{"create": s.Creates, "set": s.Sets, "modify": s.Modifies, "delete": s.Deletes},
+		Keys:          s.Keys,
+		DeletedKeys:   s.DeletedKeys,
+		RecreatedKeys: s.RecreatedKeys,
+		ObsoleteLines: s.ObsoleteLines,
+		ObsoleteRatio: s.ObsoleteRatio(),
+		CompactedSize: s.CompactedSize,
+		Hottest:       []jsonKeyStats{},
+	}
+	for _, k := range keys {
+		js.Hottest = append(js.Hottest, jsonKeyStats{Key: k.Key, Lines: k.Lines, Creates: k.Creates, Deletes: k.Deletes})
+	}
+	return json.NewEncoder(w).Encode(js)
+}
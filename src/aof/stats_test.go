@@ -0,0 +1,66 @@
+package aof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadStats(t *testing.T) {
+	data := "4\na 4\nb 1\nc 5\nd 7\nCREATE a 1\nCREATE b 2\nMODIFY a +1\nDELETE a\nCREATE a 5\nCREATE c 3\nCREATE d 4\nDELETE d\n"
+	s, err := ReadStats(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, &AOFStats{
+		Lines:         8,
+		Creates:       5,
+		Modifies:      1,
+		Deletes:       2,
+		Keys:          4,
+		DeletedKeys:   1,
+		RecreatedKeys: 1,
+		ObsoleteLines: 5,
+		CompactedSize: 47,
+		KeyStats: []KeyStats{
+			{Key: "a", Lines: 4, Creates: 2, Deletes: 1},
+			{Key: "d", Lines: 2, Creates: 1, Deletes: 1},
+			{Key: "b", Lines: 1, Creates: 1},
+			{Key: "c", Lines: 1, Creates: 1},
+		},
+	}, s)
+	assert.Equal(t, 0.625, s.ObsoleteRatio())
+
+	var compacted bytes.Buffer
+	w := NewWriter(&compacted)
+	assert.Nil(t, Compact(w, strings.NewReader(data)))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, int64(compacted.Len()), s.CompactedSize)
+
+	var out bytes.Buffer
+	assert.Nil(t, s.Write(&out, StatsTable, 2))
+	assert.Contains(t, out.String(), "obsolete lines  5 (62.5%)\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\nkey  lines  creates  deletes\na    4      2        1\nd    2      1        1\n"), out.String())
+
+	out.Reset()
+	assert.Nil(t, s.Write(&out, StatsJSON, 1))
+	assert.Equal(t, `{"lines":8,"actions":{"create":5,"delete":2,"modify":1,"set":0},"keys":4,"deleted_keys":1,"recreated_keys":1,"obsolete_lines":5,"obsolete_ratio":0.625,"compacted_size":47,"hottest":[{"key":"a","lines":4,"creates":2,"deletes":1}]}`+"\n", out.String())
+
+	s, err = ReadStats(strings.NewReader("0\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, s.ObsoleteRatio())
+
+	// the snapshot keys of a mixed AOF are live keys without body lines
+	mixed := mixedAOF("1\nk 0\nMODIFY k +1\n")
+	s, err = ReadStats(strings.NewReader(mixed))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, s.Lines)
+	assert.Equal(t, 1, s.Modifies)
+	assert.Equal(t, 2, s.Keys)
+	assert.Equal(t, 0, s.ObsoleteLines)
+	compacted.Reset()
+	w = NewWriter(&compacted)
+	assert.Nil(t, Compact(w, strings.NewReader(mixed)))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, int64(compacted.Len()), s.CompactedSize)
+}
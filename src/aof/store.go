@@ -0,0 +1,99 @@
+package aof
+
+// StoreValue is the state of a key in a store. A deleted key keeps its last
+// value until its state is dropped.
+type StoreValue struct {
+	Value   int
+	Deleted bool
+}
+
+// Store holds the state of the keys of a replay. Delete drops the state of a
+// key, a key that an AOF deletes is put with Deleted set. Iterate must not be
+// called while the store changes.
+type Store interface {
+	Get(key string) (StoreValue, bool, error)
+	Put(key string, v StoreValue) error
+	Delete(key string) error
+	Iterate(fn func(key string, v StoreValue) error) error
+}
+
+// WithStore replays the AOF with the key states held in s, which must be empty.
+// The states are not dropped after the final lines of their keys, so s holds
+// the final state of every key once the replay is done; WithEviction turns
+// dropping them back on for a store that only bounds the memory of a replay.
+func WithStore(s Store) ParserOption {
+	return func(p *AOFParser) {
+		p.store = s
+		p.evict = false
+	}
+}
+
+// WithEviction tells whether the state of a key is dropped from the store once
+// its final line is parsed. It is on unless WithStore is given.
+func WithEviction(evict bool) ParserOption {
+	return func(p *AOFParser) {
+		p.evict = evict
+	}
+}
+
+// MapStore is the in-memory store of a parser, in no particular order
+type MapStore struct {
+	values  map[string]StoreValue
+	dropped int // keys deleted since the map was last rebuilt
+}
+
+func NewMapStore() *MapStore {
+	return &MapStore{values: make(map[string]StoreValue)}
+}
+
+func (s *MapStore) Get(key string) (StoreValue, bool, error) {
+	v, exists := s.values[key]
+	return v, exists, nil
+}
+
+func (s *MapStore) Put(key string, v StoreValue) error {
+	s.values[key] = v
+	return nil
+}
+
+func (s *MapStore) Delete(key string) error {
+	if _, exists := s.values[key]; !exists {
+		return nil
+	}
+	delete(s.values, key)
+
+	// maps keep their size after deletes, so the map is rebuilt once most of it is gone
+	if s.dropped++; s.dropped >= 1024 && s.dropped > len(s.values) {
+		values := make(map[string]StoreValue, len(s.values))
+		for key, v := range s.values {
+			values[key] = v
+		}
+		s.values = values
+		s.dropped = 0
+	}
+	return nil
+}
+
+func (s *MapStore) Iterate(fn func(key string, v StoreValue) error) error {
+	for key, v := range s.values {
+		if err := fn(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearStore drops the state of every key of s
+func clearStore(s Store) error {
+	keys := []string{}
+	err := s.Iterate(func(key string, v StoreValue) error {
+		keys = append(keys, key)
+		return nil
+	})
+	for _, key := range keys {
+		if err == nil {
+			err = s.Delete(key)
+		}
+	}
+	return err
+}
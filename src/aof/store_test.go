@@ -0,0 +1,174 @@
+package aof
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storetest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]func() Store{
+		"map":   func() Store { return NewMapStore() },
+		"btree": func() Store { return NewBTreeStore() },
+		"log": func() Store {
+			s, err := NewLogStore(dir, 1024)
+			assert.Nil(t, err)
+			return s
+		},
+	}
+	compactWith := func(newStore func() Store, opts ...ParserOption) func(w *Writer, rd io.Reader) error {
+		return func(w *Writer, rd io.Reader) error {
+			s := newStore()
+			if ls, ok := s.(*LogStore); ok {
+				defer ls.Close()
+			}
+			return Compact(w, rd, append(opts, WithStore(s))...)
+		}
+	}
+
+	corpus := compactCorpus(rand.New(rand.NewSource(5)))
+	tail := [][]byte{[]byte("2\na 1\nc 0\nMODIFY c +1\nMODIFY a -2\n")}
+	for _, newStore := range stores {
+		checkCompactor(t, corpus, compactWith(newStore))
+		// the snapshot keys are put in the store before the tail is replayed
+		checkCompactor(t, tail, compactWith(newStore, WithSnapshot(map[string]int{"a": 5, "b": 6, "c": 7})), WithSnapshot(map[string]int{"a": 5, "b": 6, "c": 7}))
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.Nil(t, compactWith(stores["btree"], WithSnapshot(map[string]int{"a": 5, "b": 6, "c": 7}))(w, bytes.NewReader(tail[0])))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "2\nc 0\na 1\nCREATE c 8\nCREATE a 3\n", buf.String())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestStoreReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storetest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data := randomAOF(rand.New(rand.NewSource(6)), false, false, 3000)
+	states, err := ReadState(bytes.NewReader(data))
+	assert.Nil(t, err)
+	expected := make(map[string]StoreValue)
+	for _, s := range states {
+		expected[s.Key] = StoreValue{Value: s.Value, Deleted: s.Deleted}
+	}
+
+	logStore, err := NewLogStore(dir, 1024)
+	assert.Nil(t, err)
+	defer logStore.Close()
+	for _, s := range []Store{NewMapStore(), NewBTreeStore(), logStore} {
+		_, sorted := s.(*MapStore)
+		sorted = !sorted
+
+		// the store holds the final state of every key after the replay
+		assert.Nil(t, replay(NewAOFParser(bytes.NewReader(data), WithStore(s)), func(Event) error { return nil }))
+		actual := make(map[string]StoreValue)
+		last := ""
+		assert.Nil(t, s.Iterate(func(key string, v StoreValue) error {
+			if sorted {
+				assert.True(t, key > last, "%s after %s", key, last)
+			}
+			last = key
+			actual[key] = v
+			return nil
+		}))
+		assert.Equal(t, expected, actual)
+
+		// with eviction the states are dropped after their final lines
+		assert.Nil(t, clearStore(s))
+		assert.Nil(t, replay(NewAOFParser(bytes.NewReader(data), WithStore(s), WithEviction(true)), func(Event) error { return nil }))
+		assert.Nil(t, s.Iterate(func(key string, v StoreValue) error {
+			return fmt.Errorf("Key '%s' was not dropped", key)
+		}))
+	}
+}
+
+// unsortedStore iterates its keys in reverse order
+type unsortedStore struct {
+	*BTreeStore
+}
+
+func (s unsortedStore) Iterate(fn func(key string, v StoreValue) error) error {
+	keys, values := []string{}, []StoreValue{}
+	s.BTreeStore.Iterate(func(key string, v StoreValue) error {
+		keys, values = append(keys, key), append(values, v)
+		return nil
+	})
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompactSorted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storetest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	compactSorted := func(data []byte, s Store, opts ...ParserOption) (string, error) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		err := CompactSorted(w, bytes.NewReader(data), s, opts...)
+		assert.Nil(t, w.Close())
+		return buf.String(), err
+	}
+
+	data := []byte("4\nd 1\nc 4\nb 3\na 5\nCREATE d 1\nDELETE d\nCREATE c 1\nCREATE b 7\nMODIFY c +1\nCREATE a 5\n")
+	actual, err := compactSorted(data, NewBTreeStore())
+	assert.Nil(t, err)
+	assert.Equal(t, "3\na 0\nb 1\nc 2\nCREATE a 5\nCREATE b 7\nCREATE c 2\n", actual)
+
+	// the same live keys as Compact, in key order
+	rnd := rand.New(rand.NewSource(7))
+	var mixed bytes.Buffer
+	WriteBinarySnapshot(&mixed, []string{"z", "b", "m"}, map[string]int{"z": 1, "b": 2, "m": 3})
+	mixed.WriteString("1\nb 0\nDELETE b\n")
+	for _, data := range [][]byte{randomAOF(rnd, false, false, 2000), randomAOF(rnd, true, true, 2000), mixed.Bytes()} {
+		logStore, err := NewLogStore(dir, 1024)
+		assert.Nil(t, err)
+		for _, s := range []Store{NewBTreeStore(), logStore} {
+			actual, err := compactSorted(data, s)
+			assert.Nil(t, err)
+			states, err := ReadState(bytes.NewReader([]byte(actual)))
+			assert.Nil(t, err)
+			assert.True(t, sort.IsSorted(byKey(states)))
+
+			var expected bytes.Buffer
+			w := NewWriter(&expected)
+			assert.Nil(t, Compact(w, bytes.NewReader(data)))
+			assert.Nil(t, w.Close())
+			compacted, err := ReadState(&expected)
+			assert.Nil(t, err)
+			sort.Sort(byKey(compacted))
+			assert.Equal(t, len(compacted), len(states))
+			for i := range compacted {
+				assert.Equal(t, compacted[i].Key, states[i].Key)
+				assert.Equal(t, compacted[i].Value, states[i].Value)
+			}
+		}
+		assert.Nil(t, logStore.Close())
+	}
+
+	_, err = compactSorted(data, unsortedStore{NewBTreeStore()})
+	assert.Equal(t, ErrStoreNotSorted, err)
+	_, err = compactSorted([]byte("1\na 0\nSET a 1\n"), NewBTreeStore())
+	assert.EqualError(t, err, "ERROR at line 3: Key 'a' was not created")
+}
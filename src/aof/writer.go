@@ -0,0 +1,338 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+var (
+	ErrWriterClosed   = errors.New("AOF writer is closed")
+	ErrInvalidKey     = errors.New("Key cannot be empty or contain spaces and line breaks")
+	ErrWriterNotEmpty = errors.New("AOF writer must be a new header writer")
+	ErrStoreNotSorted = errors.New("Store does not iterate its keys in order")
+)
+
+// Writer produces an AOF file. The header must list the last line of every key,
+// so the records are buffered in memory and written out by Close, unless the
+// writer streams a footer-indexed AOF.
+type Writer struct {
+	// Checksums adds a CRC32C column to every body line and a trailer with
+	// the line count and the rolling checksum of the body. A footer writer
+	// needs it to be set before the first record.
+	Checksums bool
+
+	bw        *bufio.Writer
+	footer    bool
+	offset    int64
+	keys      []string
+	lastLines map[string]int
+	lineCount int
+	bodySize  int64 // bytes of the body lines, without the checksums
+	lines     []string
+	rolling   uint32
+	closed    bool
+	streamed  bool // the header and the body were written by streamCompacted
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		bw:        bufio.NewWriter(w),
+		lastLines: make(map[string]int),
+	}
+}
+
+// NewFooterWriter returns a writer of a footer-indexed AOF. Records go straight
+// to w, Close appends the index of the last lines.
+func NewFooterWriter(w io.Writer) *Writer {
+	fw := NewWriter(w)
+	fw.footer = true
+	return fw
+}
+
+// resumeFooterWriter continues the body of a footer-indexed AOF that ends at offset.
+// keys are in the order of their first use. A checksummed body goes on with
+// the rolling checksum of its lines.
+func resumeFooterWriter(w io.Writer, offset int64, keys []string, lastLines map[string]int, lineCount int, checksums bool, rolling uint32) *Writer {
+	fw := NewFooterWriter(w)
+	fw.Checksums = checksums
+	fw.offset = offset
+	fw.keys = keys
+	fw.lastLines = lastLines
+	fw.lineCount = lineCount
+	fw.rolling = rolling
+	return fw
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t\r\n")
+}
+
+func (w *Writer) writeString(s string) error {
+	n, err := w.bw.WriteString(s)
+	w.offset += int64(n)
+	return err
+}
+
+func (w *Writer) writeBodyLine(line string) error {
+	if w.footer && w.offset == 0 {
+		if err := w.writeString(footerMarker + "\n"); err != nil {
+			return err
+		}
+	}
+
+	if w.Checksums {
+		w.rolling = crc32.Update(w.rolling, castagnoli, []byte(line+"\n"))
+		line += " " + formatChecksum(crc32.Checksum([]byte(line), castagnoli))
+	}
+	return w.writeString(line + "\n")
+}
+
+func (w *Writer) write(key string, line string) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+
+	if w.footer {
+		if err := w.writeBodyLine(line); err != nil {
+			return err
+		}
+	} else {
+		w.lines = append(w.lines, line)
+	}
+
+	if _, exists := w.lastLines[key]; !exists {
+		w.keys = append(w.keys, key)
+	}
+	w.lastLines[key] = w.lineCount
+	w.lineCount++
+	w.bodySize += int64(len(line)) + 1
+	return nil
+}
+
+func (w *Writer) Create(key string, value int) error {
+	return w.write(key, fmt.Sprintf("CREATE %s %d", key, value))
+}
+
+func (w *Writer) Set(key string, value int) error {
+	return w.write(key, fmt.Sprintf("SET %s %d", key, value))
+}
+
+func (w *Writer) Modify(key string, delta int) error {
+	return w.write(key, fmt.Sprintf("MODIFY %s %+d", key, delta))
+}
+
+func (w *Writer) Delete(key string) error {
+	return w.write(key, fmt.Sprintf("DELETE %s", key))
+}
+
+func (w *Writer) writeEvent(typ EventType, key string, arg int) error {
+	switch typ {
+	case EventCreate:
+		return w.Create(key, arg)
+	case EventSet:
+		return w.Set(key, arg)
+	case EventModify:
+		return w.Modify(key, arg)
+	case EventDelete:
+		return w.Delete(key)
+	}
+	return fmt.Errorf("Unknown event: %v", typ)
+}
+
+// Flush writes the buffered records of a footer writer to the underlying writer
+func (w *Writer) Flush() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	return w.bw.Flush()
+}
+
+// Close writes the header, the body and the optional trailer, or the footer of a footer writer.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+
+	if !w.footer && !w.streamed {
+		w.writeString(fmt.Sprintf("%d\n", len(w.keys)))
+		for _, key := range w.keys {
+			w.writeString(fmt.Sprintf("%s %d\n", key, w.lastLines[key]))
+		}
+		for _, line := range w.lines {
+			w.writeBodyLine(line)
+		}
+	} else if w.offset == 0 {
+		w.writeString(footerMarker + "\n")
+	}
+
+	if w.Checksums && w.lineCount > 0 {
+		w.writeString(fmt.Sprintf("%s %d %s\n", trailerRecord, w.lineCount, formatChecksum(w.rolling)))
+	}
+
+	if w.footer {
+		footerStart := w.offset
+		w.writeString(fmt.Sprintf("%s %d\n", footerIndex, len(w.keys)))
+		for _, key := range w.keys {
+			w.writeString(fmt.Sprintf("%s %d\n", key, w.lastLines[key]))
+		}
+		w.writeString(fmt.Sprintf("%d\n", footerStart))
+	}
+
+	return w.bw.Flush()
+}
+
+// streamCompacted writes count keys with their values as CREATE records, the
+// way Close writes them, without keeping them in memory. each passes the keys
+// to fn in their order and is called twice, for the header and for the body.
+func (w *Writer) streamCompacted(count int, each func(fn func(key string, value int) error) error) error {
+	if w.closed {
+		return ErrWriterClosed
+	} else if w.footer || w.streamed || w.lineCount > 0 {
+		return ErrWriterNotEmpty
+	}
+	w.streamed = true
+
+	if err := w.writeString(fmt.Sprintf("%d\n", count)); err != nil {
+		return err
+	}
+	err := each(func(key string, value int) error {
+		if !validKey(key) {
+			return ErrInvalidKey
+		}
+		err := w.writeString(fmt.Sprintf("%s %d\n", key, w.lineCount))
+		w.lineCount++
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	w.lineCount = 0
+	return each(func(key string, value int) error {
+		line := fmt.Sprintf("CREATE %s %d", key, value)
+		w.lineCount++
+		w.bodySize += int64(len(line)) + 1
+		return w.writeBodyLine(line)
+	})
+}
+
+// Compact replays the AOF read from rd and writes the final value of every live key to w as a CREATE record.
+// Keys that end deleted are dropped, opts configure the parser. The caller closes w.
+func Compact(w *Writer, rd io.Reader, opts ...ParserOption) error {
+	p := NewAOFParser(rd, opts...)
+
+	// the keys of a snapshot that the tail does not use come first, once the header is read
+	snapshotDone := false
+	writeSnapshot := func() error {
+		if snapshotDone {
+			return nil
+		}
+		snapshotDone = true
+		return p.EmitUntouched(w.Create)
+	}
+
+	err := replay(p, func(event Event) error {
+		if err := writeSnapshot(); err != nil {
+			return err
+		}
+		if (event.Type&EventFinal) != EventFinal || event.Deleted {
+			return nil
+		}
+		return w.Create(event.Key, event.Value)
+	})
+	if err != nil {
+		return err
+	}
+	return writeSnapshot()
+}
+
+// CompactSorted replays the AOF read from rd with the key states held in s and
+// writes the final value of every live key to w as a CREATE record, in key
+// order. The keys are read back from s, which must iterate them in order like a
+// BTreeStore or a LogStore, and are not kept in memory. opts configure the
+// parser. w must be a new header writer, the caller closes it.
+func CompactSorted(w *Writer, rd io.Reader, s Store, opts ...ParserOption) error {
+	if err := replay(NewAOFParser(rd, append(opts, WithStore(s))...), func(Event) error { return nil }); err != nil {
+		return err
+	}
+
+	count := 0
+	err := s.Iterate(func(key string, v StoreValue) error {
+		if !v.Deleted {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.streamCompacted(count, func(fn func(key string, value int) error) error {
+		last := ""
+		return s.Iterate(func(key string, v StoreValue) error {
+			if last != "" && key <= last {
+				return ErrStoreNotSorted
+			}
+			last = key
+			if v.Deleted {
+				return nil
+			}
+			return fn(key, v.Value)
+		})
+	})
+}
+
+// CompactTail applies the AOF read from tail to the snapshot read from base and
+// writes the new snapshot to w. The tail may update the keys of the snapshot
+// without creating them. The caller closes w.
+func CompactTail(w *Writer, base io.Reader, tail io.Reader) error {
+	states, err := ReadState(base)
+	if err != nil {
+		return err
+	}
+
+	snapshot := make(map[string]int)
+	for _, s := range states {
+		if !s.Deleted {
+			snapshot[s.Key] = s.Value
+		}
+	}
+
+	final := []Event{}
+	err = replay(NewAOFParser(tail, WithSnapshot(snapshot)), func(event Event) error {
+		if (event.Type & EventFinal) == EventFinal {
+			final = append(final, event)
+			delete(snapshot, event.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the keys the tail did not touch keep their place before the tail
+	for _, s := range states {
+		if val, exists := snapshot[s.Key]; exists {
+			if err := w.Create(s.Key, val); err != nil {
+				return err
+			}
+		}
+	}
+	for _, event := range final {
+		if !event.Deleted {
+			if err := w.Create(event.Key, event.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package aof
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.Nil(t, w.Create("key1", 10))
+	assert.Nil(t, w.Create("key2", 20))
+	assert.Nil(t, w.Modify("key1", -3))
+	assert.Nil(t, w.Set("key2", 25))
+	assert.Nil(t, w.Modify("key1", 0))
+	assert.Nil(t, w.Delete("key2"))
+	assert.Equal(t, ErrInvalidKey, w.Create("key 3", 1))
+	assert.Equal(t, ErrInvalidKey, w.Create("", 1))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, ErrWriterClosed, w.Create("key3", 1))
+	assert.Equal(t, ErrWriterClosed, w.Close())
+
+	assert.Equal(t, `2
+key1 4
+key2 5
+CREATE key1 10
+CREATE key2 20
+MODIFY key1 -3
+SET key2 25
+MODIFY key1 +0
+DELETE key2
+`, buf.String())
+
+	states, err := ReadState(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "key1", Value: 7, FirstLine: 0, LastLine: 4, UpdateCount: 3},
+		{Key: "key2", Value: 25, Deleted: true, FirstLine: 1, LastLine: 5, UpdateCount: 3},
+	}, states)
+}
+
+func TestWriterChecksums(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Checksums = true
+	w.Create("key1", 10)
+	w.Modify("key1", 5)
+	w.Delete("key1")
+	assert.Nil(t, w.Close())
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, 7, len(lines))
+	assert.Regexp(t, `^CREATE key1 10 #[0-9a-f]{8}$`, lines[2])
+	assert.Regexp(t, `^TRAILER 3 #[0-9a-f]{8}$`, lines[5])
+
+	states, err := ReadState(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{{Key: "key1", Value: 15, Deleted: true, LastLine: 2, UpdateCount: 3}}, states)
+
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Checksums = true
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "0\n", buf.String())
+}
+
+func randomAOF(rnd *rand.Rand, footer, checksums bool, lines int) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if footer {
+		w = NewFooterWriter(&buf)
+	}
+	w.Checksums = checksums
+
+	values := make(map[string]int)
+	for i := 0; i < lines; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(50))
+		if _, live := values[key]; !live {
+			values[key] = rnd.Intn(100)
+			w.Create(key, values[key])
+			continue
+		}
+		switch rnd.Intn(3) {
+		case 0:
+			w.Set(key, rnd.Intn(100))
+		case 1:
+			w.Modify(key, rnd.Intn(20)-10)
+		case 2:
+			delete(values, key)
+			w.Delete(key)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// compactCorpus returns random AOFs of every kind, a mixed AOF and the edge cases
+// of the parser, the inputs every compactor is checked against
+func compactCorpus(rnd *rand.Rand) [][]byte {
+	corpus := [][]byte{}
+	for _, footer := range []bool{false, true} {
+		for _, checksums := range []bool{false, true} {
+			for _, lines := range []int{1, 7, 500, 3000} {
+				corpus = append(corpus, randomAOF(rnd, footer, checksums, lines))
+			}
+		}
+	}
+
+	for _, tail := range []string{"1\nb 0\nMODIFY b +5\n", "2\nb 1\nd 0\nCREATE d 4\nMODIFY b +5\n"} {
+		var mixed bytes.Buffer
+		WriteBinarySnapshot(&mixed, []string{"a", "b", "c"}, map[string]int{"a": 1, "b": 2, "c": 3})
+		mixed.WriteString(tail)
+		corpus = append(corpus, mixed.Bytes())
+	}
+
+	for _, data := range []string{
+		"",
+		"0\n",
+		"1\na 0\nCREATE a 1\nCREATE b 2\n", // lines after the last declared one are not parsed
+		"2\na 0\nb 1\nCREATE a 1\nCREATE b 2\r\n",                          // \r\n line ends
+		"2\na 0\nb 1\nCREATE a 1\nCREATE a 2\n",                            // a is used after its last line
+		"2\na 0\nb 2\nCREATE a 1\nCREATE b 2\n",                            // missing line
+		"2\na 1\nb 0\nCREATE b 1\nSET a 2\n",                               // a was not created
+		"2\na 0\nb 1\nSET a 1\nCREATE b x\n",                               // the SET error comes first
+		"2\na 1\nb 0\nCREATE b x\nSET a 1\n",                               // the parse error comes first
+		"1\na 1\nCREATE a 1\nMODIFY a 2\n",                                 // MODIFY without an operator
+		"1\na 1\nCREATE a 1\nCREATE c 2\n",                                 // c is not in the header
+		"1\na 1\nCREATE  a\t1\n MODIFY a +2\n",                             // leading space
+		"1\na 0\nCREATE a 1\nTRAILER 1 #4c3b2a1f\n",                        // the checksums were removed
+		"2\na 1\nb 2\nCREATE a 1\nCREATE b 2\nDELETE b\nCREATE a 3\n",      // a key ends deleted
+		"3\na 2\nb 1\nc 3\nCREATE b 1\nDELETE b\nCREATE a 3\nCREATE c 4\n", // a key is created again
+		"2\na 0\nb 1\nCREATE a 1\nCREATE b 2\nMODIFY a +1\n",               // a is modified after its last line
+	} {
+		corpus = append(corpus, []byte(data))
+	}
+	return corpus
+}
+
+// checkCompactor checks that compact writes the same AOF as Compact with opts,
+// or fails with the same error, for every input and with or without checksums
+func checkCompactor(t *testing.T, inputs [][]byte, compact func(w *Writer, rd io.Reader) error, opts ...ParserOption) {
+	for i, data := range inputs {
+		for _, checksums := range []bool{false, true} {
+			var expected, actual bytes.Buffer
+			w := NewWriter(&expected)
+			w.Checksums = checksums
+			expectedErr := Compact(w, bytes.NewReader(data), opts...)
+			w.Close()
+
+			w = NewWriter(&actual)
+			w.Checksums = checksums
+			err := compact(w, bytes.NewReader(data))
+			w.Close()
+
+			if expectedErr == nil {
+				assert.Nil(t, err, "input %d, checksums %t", i, checksums)
+				assert.Equal(t, expected.String(), actual.String(), "input %d, checksums %t", i, checksums)
+			} else {
+				assert.EqualError(t, err, expectedErr.Error(), "input %d, checksums %t", i, checksums)
+			}
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Checksums = true
+	assert.Nil(t, Compact(w, strings.NewReader(`4
+key1 1
+key2 2
+key3 3
+key4 6
+CREATE  key1 1000
+MODIFY  key1 +1
+CREATE  key2 2000
+CREATE  key3 3000
+CREATE  key4 4000
+SET     key4 4500
+DELETE  key4
+`)))
+	assert.Nil(t, w.Close())
+
+	states, err := ReadState(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyState{
+		{Key: "key1", Value: 1001, FirstLine: 0, LastLine: 0, UpdateCount: 1},
+		{Key: "key2", Value: 2000, FirstLine: 1, LastLine: 1, UpdateCount: 1},
+		{Key: "key3", Value: 3000, FirstLine: 2, LastLine: 2, UpdateCount: 1},
+	}, states)
+}
+
+func TestCompactTail(t *testing.T) {
+	base := "3\nkey1 0\nkey2 1\nkey3 2\nCREATE key1 1\nCREATE key2 2\nCREATE key3 3\n"
+
+	tests := []struct {
+		tail   string
+		output string
+		err    string
+	}{
+		{
+			tail:   "4\nkey2 0\nkey3 1\nkey4 3\nkey1 4\nMODIFY key2 +5\nDELETE key3\nCREATE key4 4\nDELETE key4\nSET key1 10\n",
+			output: "2\nkey2 0\nkey1 1\nCREATE key2 7\nCREATE key1 10\n",
+		},
+		{
+			tail:   "2\nkey3 1\nkey5 2\nDELETE key3\nCREATE key3 30\nCREATE key5 5\n",
+			output: "4\nkey1 0\nkey2 1\nkey3 2\nkey5 3\nCREATE key1 1\nCREATE key2 2\nCREATE key3 30\nCREATE key5 5\n",
+		},
+		{
+			tail:   "0",
+			output: "3\nkey1 0\nkey2 1\nkey3 2\nCREATE key1 1\nCREATE key2 2\nCREATE key3 3\n",
+		},
+		{
+			tail: "1\nkey1 0\nCREATE key1 5\n",
+			err:  "ERROR at line 3: Key 'key1' has already been created",
+		},
+		{
+			tail: "1\nkey6 0\nMODIFY key6 +5\n",
+			err:  "ERROR at line 3: Key 'key6' was not created",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		err := CompactTail(w, strings.NewReader(base), strings.NewReader(test.tail))
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.tail)
+			continue
+		}
+		assert.Nil(t, err, test.tail)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, test.output, buf.String(), test.tail)
+	}
+}
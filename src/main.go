@@ -3,72 +3,913 @@ package main
 import (
 	"aof"
 	"bufio"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func usage() {
-	fmt.Fprintf(os.Stdout, `Usage: aofcompactor [FILE]
+	fmt.Fprintf(os.Stdout, `Usage: aofcompactor [STREAM OPTIONS] [--aof] [--checksum] [--base SNAPSHOT] [--snapshot] [--parallel N]
+                   [--spill LIMIT] [--spill-dir DIR] [--store map|btree|log] [--sort line|key] [FILE]
+       aofcompactor export [STREAM OPTIONS] [--format csv|tsv] [--sort key|line] [FILE]
+       aofcompactor merge [STREAM OPTIONS] [--policy last|sum|error] [--checksum] FILE...
+       aofcompactor merge3 [STREAM OPTIONS] [--modify sum|conflict] [--set theirs|ours|conflict]
+                    [--delete delete|update|conflict] [--report FILE] [--checksum] BASE OURS THEIRS
+       aofcompactor follow [--key PATTERN] [--type TYPES] [--poll DURATION] FILE
+       aofcompactor history [--index] KEY FILE
+       aofcompactor get [STREAM OPTIONS] KEY [FILE]
+       aofcompactor exists [STREAM OPTIONS] KEY [FILE]
+       aofcompactor keys [STREAM OPTIONS] [PATTERN [FILE]]
+       aofcompactor diff [STREAM OPTIONS] [--format text|json|unified] [--patch FILE] A B
+       aofcompactor stats [STREAM OPTIONS] [--format table|json] [--top N] [FILE]
+       aofcompactor index [--interval M] [--checkpoint C] FILE
 Compact AOF [FILE] or standard input to standard output.
 
-When FILE is -, read standard input.
+When FILE is -, read standard input. Gzipped input is decompressed on the fly.
+
+Stream options:
+  --compress           gzip the output
+  --decrypt-key KEY    decrypt the input
+  --encrypt-key KEY    encrypt the output
+KEY is a file holding a 32-byte key, raw or hex encoded, or env:NAME to read it
+from the NAME environment variable.
+
+--aof writes the compacted state as a valid AOF file where deleted keys are
+dropped, --checksum adds CRC32C checksums and a trailer to it (implies --aof).
+--base applies FILE as the tail of the compacted SNAPSHOT and writes the new
+snapshot (implies --aof); the tail may update the keys of SNAPSHOT without
+creating them. --snapshot writes the compacted state as a mixed AOF that starts
+with a binary snapshot of the live keys, which parses faster than text; appended
+text records may update its keys without creating them. --parallel parses the
+body of FILE in N chunks at once and writes the same AOF (implies --aof); inputs
+that cannot be split, like standard input, are compacted by one worker.
+--spill keeps the key states under LIMIT bytes of memory (K, M and G suffixes)
+by sorting them in run files in --spill-dir, the temporary directory by
+default, and writes the same AOF (implies --aof). The keys of the header count
+against LIMIT but stay in memory, even when they do not fit; an AOF without a
+header or a footer index is not supported. --store holds the key states
+in a hash map (map, the default), a sorted B-tree (btree) or log-structured
+files in the temporary directory (log) for more keys than fit in memory.
+--sort key writes the live keys in key order, read back from a sorted --store
+(btree, the default, or log), instead of the order of their last lines
+(implies --aof).
+
+Commands:
+  export    write the final state of every key as CSV or TSV with the columns
+            key,value,deleted,last_line,first_line,update_count; lines are body
+            lines, counted from 0 as in the header
+  merge     write the combined final state of several AOF files as one AOF; a
+            key used by several files takes the state of the last file (last),
+            its last created or set value plus the MODIFY deltas of every file
+            (sum) or fails the merge (error)
+  merge3    merge OURS and THEIRS, two copies of BASE that kept appending
+            records, into one AOF. A key both sides changed is resolved by
+            --modify when both only modified it (sum adds the deltas), by --set
+            when a side created or set it (the given side wins) and by --delete
+            when one side deleted it (delete or update wins). Unresolved keys
+            keep the state of OURS and are reported as key, reason, base, ours
+            and theirs columns to the --report FILE or standard error; the exit
+            code is 3 then
+  follow    print the body events of FILE as it grows, like tail -f, as lines of
+            body line, action, key and new value; a truncated or rotated FILE is
+            followed from its start. --key keeps the keys matching the shell
+            PATTERN, --type the comma separated actions (create,set,modify,delete)
+            and --poll sets how often FILE is checked for new data (default 200ms)
+  history   print every body line of KEY in FILE as body line, action, delta,
+            value before and after and whether the key is deleted; the values
+            of a deleted key are 0 and every CREATE starts a new cycle. The
+            FILE.offsets index is used when it matches FILE, --index builds it
+            first when it is missing or out of date
+  get       print the value of KEY. The input is read only up to the last
+            line its header declares for KEY. The exit code is 3 when KEY is
+            deleted, 4 when the header declares KEY but the body never creates
+            it and 5 when the header does not declare KEY
+  exists    like get, without printing the value
+  keys      print the live keys matching the shell PATTERN (default *), sorted
+  diff      compare the final states of A and B: keys only in A or only in B,
+            values that changed and keys deleted on one side while live on the
+            other. unified writes a diff -u of the sorted "key value" lines of
+            the live keys. --patch writes to FILE the AOF records that turn the
+            state of A into the state of B, to apply with --base. The exit code
+            is 3 when the states differ
+  stats     count the body lines per action, the keys, the keys that end
+            deleted or were created more than once, the lines that compaction
+            drops and the size of the compacted AOF, then list the --top N keys
+            that use the most lines (default 10, 0 lists every key) with their
+            CREATE and DELETE counts
+  index     write the FILE.offsets index for random access to FILE: the byte
+            offset and the checksum of every block of M body lines (default
+            1024), the body lines of every key and the live keys before every
+            C-th body line (default 65536, a multiple of M). The index is bound
+            to the size and the modification time of FILE, a block is checked
+            against its checksum when it is read
 `)
 	os.Exit(255)
 }
 
-func main() {
-	var reader io.Reader
-	var f *os.File
-	var err error
+// streamFlags are the input and output options shared by the commands
+type streamFlags struct {
+	compress   *bool
+	decryptKey *string
+	encryptKey *string
+}
 
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
-		reader = bufio.NewReader(os.Stdin)
-	} else {
-		if len(os.Args) <= 1 {
+func addStreamFlags(fs *flag.FlagSet) *streamFlags {
+	return &streamFlags{
+		compress:   fs.Bool("compress", false, ""),
+		decryptKey: fs.String("decrypt-key", "", ""),
+		encryptKey: fs.String("encrypt-key", "", ""),
+	}
+}
+
+func loadKey(spec string) []byte {
+	key, err := aof.LoadKey(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load key '%s': %s\n", spec, err)
+		os.Exit(1)
+	}
+	return key
+}
+
+// openInput returns a reader for the FILE argument or for the piped standard input
+func openInput(args []string, sf *streamFlags) (io.Reader, func()) {
+	var input io.ReadCloser = os.Stdin
+	name := "standard input"
+
+	if len(args) == 0 {
+		stat, _ := os.Stdin.Stat()
+		if (stat.Mode() & os.ModeCharDevice) != 0 {
 			usage()
 		}
-
-		if os.Args[1] == "-" {
-			reader = bufio.NewReader(os.Stdin)
+	} else if args[0] != "-" {
+		var err error
+		name = "'" + args[0] + "' file"
+		if *sf.decryptKey != "" {
+			input, err = os.Open(args[0])
 		} else {
-			f, err = os.Open(os.Args[1])
+			input, err = aof.OpenFile(args[0])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open %s: %s\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	// files are not buffered here, so they stay seekable for footer-indexed AOFs
+	var reader io.Reader = input
+	var err error
+	if *sf.decryptKey != "" {
+		reader, err = aof.NewDecryptReader(reader, loadKey(*sf.decryptKey))
+	}
+	if err == nil && (*sf.decryptKey != "" || input == os.Stdin) {
+		reader, err = aof.Decompress(reader)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s: %s\n", name, err)
+		os.Exit(1)
+	}
+
+	return reader, func() { input.Close() }
+}
+
+// openOutput returns the standard output writer, gzipped and encrypted as requested.
+// The returned function flushes all pending output and returns the first error.
+// Only its first call does it, so it is also deferred for the error paths.
+func openOutput(sf *streamFlags) (io.Writer, func() error) {
+	out := bufio.NewWriter(os.Stdout)
+	closers := []io.Closer{}
+
+	var w io.Writer = out
+	if *sf.encryptKey != "" {
+		enc, err := aof.NewEncryptWriter(w, loadKey(*sf.encryptKey))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot encrypt output: %s\n", err)
+			os.Exit(1)
+		}
+		w = enc
+		closers = append(closers, enc)
+	}
+	if *sf.compress {
+		gz := aof.NewCompressWriter(w)
+		w = gz
+		closers = append(closers, gz)
+	}
+
+	closed := false
+	return w, func() error {
+		if closed {
+			return nil
+		}
+		closed = true
+
+		var err error
+		for i := len(closers) - 1; i >= 0; i-- {
+			if cerr := closers[i].Close(); err == nil {
+				err = cerr
+			}
+		}
+		if ferr := out.Flush(); err == nil {
+			err = ferr
+		}
+		return err
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = usage
+	return fs
+}
+
+func compactCommand(args []string) int {
+	fs := newFlagSet("compact")
+	sf := addStreamFlags(fs)
+	asAOF := fs.Bool("aof", false, "")
+	checksum := fs.Bool("checksum", false, "")
+	base := fs.String("base", "", "")
+	snapshot := fs.Bool("snapshot", false, "")
+	parallel := fs.Int("parallel", 0, "")
+	spill := fs.String("spill", "", "")
+	spillDir := fs.String("spill-dir", "", "")
+	storeName := fs.String("store", "", "")
+	order := fs.String("sort", "line", "")
+	if fs.Parse(args) != nil || (*order != "line" && *order != "key") || (*snapshot && (*base != "" || *checksum)) ||
+		*parallel < 0 || (*parallel > 0 && (*base != "" || *snapshot)) {
+		usage()
+	}
+
+	spillOpts := aof.DefaultSpillOptions
+	spillOpts.Dir = *spillDir
+	if *spill != "" || *spillDir != "" {
+		if *base != "" || *snapshot || *parallel > 0 {
+			usage()
+		}
+		if *spill != "" {
+			limit, err := parseSize(*spill)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Cannot open '%s' file\n", os.Args[1])
-				os.Exit(1)
+				usage()
 			}
-			defer f.Close()
-			reader = bufio.NewReader(f)
+			spillOpts.MemoryLimit = limit
+		}
+	}
+	if *order == "key" {
+		if *storeName == "map" {
+			usage()
+		} else if *storeName == "" {
+			*storeName = "btree"
 		}
+	}
+	if *storeName != "" && (*base != "" || *snapshot || *parallel > 0 || *spill != "" || *spillDir != "") {
+		usage()
+	}
+	store, closeStore := openStore(*storeName)
+	defer closeStore()
+	// the states are dropped after their final lines unless they are read back
+	opts := []aof.ParserOption{aof.WithStore(store), aof.WithEviction(true)}
+
+	reader, closeInput := openInput(fs.Args(), sf)
+	defer closeInput()
 
+	if *base != "" {
+		baseReader, closeBase := openInput([]string{*base}, sf)
+		defer closeBase()
+		return compactAOF(sf, *checksum, func(w *aof.Writer) error {
+			return aof.CompactTail(w, baseReader, reader)
+		})
+	}
+	if *snapshot {
+		out, closeOutput := openOutput(sf)
+		defer closeOutput()
+		if err := aof.CompactSnapshot(out, reader); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+			return 2
+		}
+		if err := closeOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	if *spill != "" || *spillDir != "" {
+		return compactAOF(sf, *checksum, func(w *aof.Writer) error {
+			return aof.SpillCompact(w, reader, spillOpts)
+		})
+	}
+	if *order == "key" {
+		return compactAOF(sf, *checksum, func(w *aof.Writer) error {
+			return aof.CompactSorted(w, reader, store)
+		})
+	}
+	if *parallel > 0 {
+		return compactAOF(sf, *checksum, func(w *aof.Writer) error {
+			if rs, ok := reader.(io.ReadSeeker); ok {
+				return aof.CompactParallel(w, rs, *parallel)
+			}
+			return aof.Compact(w, reader)
+		})
+	}
+	if *asAOF || *checksum {
+		return compactAOF(sf, *checksum, func(w *aof.Writer) error {
+			return aof.Compact(w, reader, opts...)
+		})
 	}
 
-	parser := aof.NewAOFParser(reader)
+	parser := aof.NewAOFParser(reader, opts...)
 	go parser.Parse()
 	defer parser.Quit()
 
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	// the keys of a snapshot that the tail does not use come first
+	snapshotDone := false
 	for {
 		event := parser.NextEvent()
 		//fmt.Printf("Recv event=%v\n", event)
-		if event.Type == aof.EventQuit || event.Type == aof.EventError || event.Type == aof.EventCompleted {
-			if event.Type == aof.EventError {
-				fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", parser.Error())
-				os.Exit(2)
-			}
+		if event.Type == aof.EventError {
+			fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", parser.Error())
+			return 2
+		}
+		if event.Type == aof.EventHeader {
+			continue
+		}
+		if !snapshotDone {
+			snapshotDone = true
+			parser.EmitUntouched(func(key string, value int) error {
+				_, err := fmt.Fprintf(out, "CREATE %s %d\n", key, value)
+				return err
+			})
+		}
+		if event.Type == aof.EventQuit || event.Type == aof.EventCompleted {
 			break
 		}
 
 		if (event.Type & aof.EventFinal) == aof.EventFinal {
 			switch event.Type & ^aof.EventFinal {
 			case aof.EventCreate, aof.EventSet, aof.EventModify:
-				fmt.Fprintf(os.Stdout, "CREATE %s %d\n", event.Key, event.Value)
+				fmt.Fprintf(out, "CREATE %s %d\n", event.Key, event.Value)
 			case aof.EventDelete:
-				fmt.Fprintf(os.Stdout, "DELETE %s\n", event.Key)
+				fmt.Fprintf(out, "DELETE %s\n", event.Key)
 			}
 		}
 	}
 
+	if err := closeOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// openStore returns the named key state store of the compactor and a function that removes it
+func openStore(name string) (aof.Store, func()) {
+	switch name {
+	case "", "map":
+		return aof.NewMapStore(), func() {}
+	case "btree":
+		return aof.NewBTreeStore(), func() {}
+	case "log":
+		store, err := aof.NewLogStore("", aof.DefaultLogStoreLimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create store: %s\n", err)
+			os.Exit(1)
+		}
+		return store, func() { store.Close() }
+	}
+	usage()
+	return nil, nil
+}
+
+// parseSize parses a positive number of bytes with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && (n <= 0 || n > math.MaxInt64>>shift) {
+		err = fmt.Errorf("Invalid size: %s", s)
+	}
+	return n << shift, err
+}
+
+func compactAOF(sf *streamFlags, checksum bool, compact func(*aof.Writer) error) int {
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	w := aof.NewWriter(out)
+	w.Checksums = checksum
+	if err := compact(w); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+		return 2
+	}
+
+	err := w.Close()
+	if err == nil {
+		err = closeOutput()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func exportCommand(args []string) int {
+	fs := newFlagSet("export")
+	format := fs.String("format", "csv", "")
+	order := fs.String("sort", "key", "")
+	sf := addStreamFlags(fs)
+	if fs.Parse(args) != nil {
+		usage()
+	}
+
+	var exportFormat aof.ExportFormat
+	switch *format {
+	case "csv":
+		exportFormat = aof.ExportCSV
+	case "tsv":
+		exportFormat = aof.ExportTSV
+	default:
+		usage()
+	}
+
+	var exportOrder aof.ExportOrder
+	switch *order {
+	case "key":
+		exportOrder = aof.OrderByKey
+	case "line":
+		exportOrder = aof.OrderByLine
+	default:
+		usage()
+	}
+
+	reader, closeInput := openInput(fs.Args(), sf)
+	defer closeInput()
+
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	if err := aof.Export(out, reader, exportFormat, exportOrder); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot export file: %s\n", err)
+		return 2
+	}
+	if err := closeOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func mergeCommand(args []string) int {
+	fs := newFlagSet("merge")
+	sf := addStreamFlags(fs)
+	policyName := fs.String("policy", "last", "")
+	checksum := fs.Bool("checksum", false, "")
+	if fs.Parse(args) != nil || fs.NArg() == 0 {
+		usage()
+	}
+
+	policy, err := aof.ParseMergePolicy(*policyName)
+	if err != nil {
+		usage()
+	}
+
+	inputs := []io.Reader{}
+	for _, name := range fs.Args() {
+		reader, closeInput := openInput([]string{name}, sf)
+		defer closeInput()
+		inputs = append(inputs, reader)
+	}
+
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	w := aof.NewWriter(out)
+	w.Checksums = *checksum
+	if err := aof.Merge(w, policy, inputs...); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot merge files: %s\n", err)
+		return 2
+	}
+
+	err = w.Close()
+	if err == nil {
+		err = closeOutput()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func merge3Command(args []string) int {
+	fs := newFlagSet("merge3")
+	sf := addStreamFlags(fs)
+	modify := fs.String("modify", "sum", "")
+	set := fs.String("set", "theirs", "")
+	del := fs.String("delete", "delete", "")
+	report := fs.String("report", "", "")
+	checksum := fs.Bool("checksum", false, "")
+	if fs.Parse(args) != nil || fs.NArg() != 3 {
+		usage()
+	}
+
+	opts := aof.Merge3Options{}
+	modifyStrategies := map[string]aof.ModifyStrategy{"sum": aof.ModifySum, "conflict": aof.ModifyConflict}
+	setStrategies := map[string]aof.SetStrategy{"theirs": aof.SetTheirs, "ours": aof.SetOurs, "conflict": aof.SetConflict}
+	deleteStrategies := map[string]aof.DeleteStrategy{"delete": aof.DeleteWins, "update": aof.UpdateWins, "conflict": aof.DeleteConflict}
+	var found [3]bool
+	opts.Modify, found[0] = modifyStrategies[*modify]
+	opts.Set, found[1] = setStrategies[*set]
+	opts.Delete, found[2] = deleteStrategies[*del]
+	if !found[0] || !found[1] || !found[2] {
+		usage()
+	}
+
+	inputs := []io.Reader{}
+	for _, name := range fs.Args() {
+		reader, closeInput := openInput([]string{name}, sf)
+		defer closeInput()
+		inputs = append(inputs, reader)
+	}
+
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	w := aof.NewWriter(out)
+	w.Checksums = *checksum
+	conflicts, err := aof.Merge3(w, inputs[0], inputs[1], inputs[2], opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot merge files: %s\n", err)
+		return 2
+	}
+	err = w.Close()
+	if err == nil {
+		err = closeOutput()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	if len(conflicts) == 0 {
+		return 0
+	}
+
+	reportFile := os.Stderr
+	if *report != "" {
+		if reportFile, err = os.Create(*report); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create '%s' report: %s\n", *report, err)
+			return 1
+		}
+		defer reportFile.Close()
+	}
+
+	fmt.Fprintf(reportFile, "key\treason\tbase\tours\ttheirs\n")
+	for _, c := range conflicts {
+		fmt.Fprintf(reportFile, "%s\t%s\t%s\t%s\t%s\n", c.Key, c.Reason, c.Base, c.Ours, c.Theirs)
+	}
+	return 3
+}
+
+var actionNames = map[aof.EventType]string{
+	aof.EventCreate: "CREATE",
+	aof.EventSet:    "SET",
+	aof.EventModify: "MODIFY",
+	aof.EventDelete: "DELETE",
+}
+
+func followCommand(args []string) int {
+	fs := newFlagSet("follow")
+	keyPattern := fs.String("key", "*", "")
+	types := fs.String("type", "create,set,modify,delete", "")
+	poll := fs.Duration("poll", 200*time.Millisecond, "")
+	if fs.Parse(args) != nil || fs.NArg() != 1 || *poll <= 0 {
+		usage()
+	}
+	if _, err := path.Match(*keyPattern, ""); err != nil {
+		usage()
+	}
+
+	actions := make(map[aof.EventType]bool)
+	for _, name := range strings.Split(*types, ",") {
+		found := false
+		for typ, action := range actionNames {
+			if strings.EqualFold(name, action) {
+				actions[typ], found = true, true
+			}
+		}
+		if !found {
+			usage()
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open '%s' file: %s\n", fs.Arg(0), err)
+		return 1
+	}
+	defer f.Close()
+
+	parser := aof.NewAOFParser(f, aof.WithFollow(*poll))
+	go parser.Parse()
+	defer parser.Quit()
+
+	for {
+		event := parser.NextEvent()
+		typ := event.Type & ^aof.EventFinal
+		switch {
+		case typ == aof.EventError:
+			fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", parser.Error())
+			return 2
+		case typ == aof.EventQuit:
+			return 0
+		case !actions[typ]:
+			continue
+		}
+
+		if matched, _ := path.Match(*keyPattern, event.Key); !matched {
+			continue
+		}
+		if typ == aof.EventDelete {
+			fmt.Fprintf(os.Stdout, "%d %s %s\n", event.Line, actionNames[typ], event.Key)
+		} else {
+			fmt.Fprintf(os.Stdout, "%d %s %s %d\n", event.Line, actionNames[typ], event.Key, event.Value)
+		}
+	}
+}
+
+func historyCommand(args []string) int {
+	fs := newFlagSet("history")
+	index := fs.Bool("index", false, "")
+	if fs.Parse(args) != nil || fs.NArg() != 2 {
+		usage()
+	}
+	key, name := fs.Arg(0), fs.Arg(1)
+
+	if *index && !aof.OffsetIndexUpToDate(name) {
+		if err := aof.BuildOffsetIndex(name, aof.DefaultOffsetIndexOptions); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot index '%s' file: %s\n", name, err)
+			return 2
+		}
+	}
+
+	cycle := 0
+	fmt.Fprintf(os.Stdout, "line\taction\tdelta\tbefore\tafter\tdeleted\n")
+	err := aof.FileHistory(name, key, func(entry aof.HistoryEntry) error {
+		if entry.Cycle != cycle {
+			cycle = entry.Cycle
+			fmt.Fprintf(os.Stdout, "# cycle %d\n", cycle)
+		}
+		fmt.Fprintf(os.Stdout, "%d\t%s\t%+d\t%d\t%d\t%t\n", entry.Line, actionNames[entry.Action], entry.Delta, entry.Before, entry.After, entry.Deleted)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Cannot open '%s' file: %s\n", name, err)
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+		return 2
+	}
+	return 0
+}
+
+func lookupCommand(name string, print bool) func([]string) int {
+	return func(args []string) int {
+		fs := newFlagSet(name)
+		sf := addStreamFlags(fs)
+		if fs.Parse(args) != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+			usage()
+		}
+		key := fs.Arg(0)
+
+		reader, closeInput := openInput(fs.Args()[1:], sf)
+		defer closeInput()
+
+		v, status, err := aof.Lookup(reader, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+			return 2
+		}
+
+		switch status {
+		case aof.KeyDeleted:
+			fmt.Fprintf(os.Stderr, "Key '%s' is deleted\n", key)
+			return 3
+		case aof.KeyNeverCreated:
+			fmt.Fprintf(os.Stderr, "Key '%s' was never created\n", key)
+			return 4
+		case aof.KeyNotDeclared:
+			fmt.Fprintf(os.Stderr, "Key '%s' is not declared\n", key)
+			return 5
+		}
+		if print {
+			fmt.Fprintf(os.Stdout, "%d\n", v)
+		}
+		return 0
+	}
+}
+
+func keysCommand(args []string) int {
+	fs := newFlagSet("keys")
+	sf := addStreamFlags(fs)
+	if fs.Parse(args) != nil || fs.NArg() > 2 {
+		usage()
+	}
+	pattern := "*"
+	if fs.NArg() > 0 {
+		pattern = fs.Arg(0)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		usage()
+	}
+
+	var inputArgs []string
+	if fs.NArg() > 1 {
+		inputArgs = fs.Args()[1:]
+	}
+	reader, closeInput := openInput(inputArgs, sf)
+	defer closeInput()
+
+	values, err := aof.LookupKeys(reader, pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+		return 2
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintln(os.Stdout, key)
+	}
+	return 0
+}
+
+func diffCommand(args []string) int {
+	fs := newFlagSet("diff")
+	sf := addStreamFlags(fs)
+	formatName := fs.String("format", "text", "")
+	patch := fs.String("patch", "", "")
+	if fs.Parse(args) != nil || fs.NArg() != 2 {
+		usage()
+	}
+
+	format, err := aof.ParseDiffFormat(*formatName)
+	if err != nil {
+		usage()
+	}
+
+	inputs := []io.Reader{}
+	for _, name := range fs.Args() {
+		reader, closeInput := openInput([]string{name}, sf)
+		defer closeInput()
+		inputs = append(inputs, reader)
+	}
+
+	d, err := aof.Diff(inputs[0], inputs[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot compare files: %s\n", err)
+		return 2
+	}
+
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	err = d.Write(out, format, fs.Arg(0), fs.Arg(1))
+	if err == nil {
+		err = closeOutput()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+
+	if *patch != "" {
+		f, err := os.Create(*patch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create '%s' patch: %s\n", *patch, err)
+			return 1
+		}
+		defer f.Close()
+
+		w := aof.NewWriter(f)
+		err = d.WritePatch(w)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write '%s' patch: %s\n", *patch, err)
+			return 1
+		}
+	}
+
+	if len(d.Keys) > 0 {
+		return 3
+	}
+	return 0
+}
+
+func statsCommand(args []string) int {
+	fs := newFlagSet("stats")
+	sf := addStreamFlags(fs)
+	formatName := fs.String("format", "table", "")
+	top := fs.Int("top", 10, "")
+	if fs.Parse(args) != nil || *top < 0 {
+		usage()
+	}
+
+	format, err := aof.ParseStatsFormat(*formatName)
+	if err != nil {
+		usage()
+	}
+
+	reader, closeInput := openInput(fs.Args(), sf)
+	defer closeInput()
+
+	stats, err := aof.ReadStats(reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot parse file: %s\n", err)
+		return 2
+	}
+
+	out, closeOutput := openOutput(sf)
+	defer closeOutput()
+
+	err = stats.Write(out, format, *top)
+	if err == nil {
+		err = closeOutput()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write output: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func indexCommand(args []string) int {
+	fs := newFlagSet("index")
+	opts := aof.DefaultOffsetIndexOptions
+	fs.IntVar(&opts.Interval, "interval", opts.Interval, "")
+	fs.IntVar(&opts.CheckpointInterval, "checkpoint", opts.CheckpointInterval, "")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		usage()
+	}
+
+	err := aof.BuildOffsetIndex(fs.Arg(0), opts)
+	switch {
+	case err == aof.ErrInvalidIndexOptions:
+		usage()
+	case os.IsNotExist(err):
+		fmt.Fprintf(os.Stderr, "Cannot open '%s' file: %s\n", fs.Arg(0), err)
+		return 1
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Cannot index '%s' file: %s\n", fs.Arg(0), err)
+		return 2
+	}
+	return 0
+}
+
+var commands = map[string]func([]string) int{
+	"index":   indexCommand,
+	"stats":   statsCommand,
+	"diff":    diffCommand,
+	"get":     lookupCommand("get", true),
+	"exists":  lookupCommand("exists", false),
+	"keys":    keysCommand,
+	"history": historyCommand,
+	"follow":  followCommand,
+	"merge3":  merge3Command,
+	"export":  exportCommand,
+	"merge":   mergeCommand,
+}
+
+func main() {
+	var code int
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		code = commands[os.Args[1]](os.Args[2:])
+	} else {
+		code = compactCommand(os.Args[1:])
+	}
+
 	os.Stdout.Sync()
-	os.Exit(0)
+	os.Exit(code)
 }